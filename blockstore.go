@@ -0,0 +1,413 @@
+/*
+ * Copyright 2025 Nathanne Isip
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/sys/unix"
+)
+
+// DEFAULT_FILE_BLOCK_SIZE is the plaintext size of a single block when the
+// user doesn't override it with -file-block-size. gocryptfs uses the same
+// default for the same reason: it's a common page/FS block size, so most
+// reads and writes touch a single block.
+const DEFAULT_FILE_BLOCK_SIZE = 4096
+
+const (
+	blockNonceSize = 12
+	blockTagSize   = 16
+)
+
+// BlockStore owns the on-disk block files that back file content. Every
+// inode gets its own block file at Dir()/<inode>.blk, addressed by
+// (inode, blockNo); nothing is ever kept in RAM beyond the block currently
+// being read or written.
+type BlockStore struct {
+	dir       string
+	blockSize int
+	masterKey [32]byte
+
+	mux   sync.Mutex
+	files map[uint64]*os.File
+}
+
+// NewBlockStore creates a block store rooted at dir, generating a fresh
+// random master key. Used when there's no existing disk image to load.
+func NewBlockStore(dir string, blockSize int) (*BlockStore, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, fmt.Errorf("generate master key: %w", err)
+	}
+
+	return openBlockStore(dir, blockSize, key)
+}
+
+// OpenBlockStore reopens a block store with a master key recovered from
+// the disk image (see SerializableX25fs.MasterKey).
+func OpenBlockStore(dir string, blockSize int, masterKey [32]byte) (*BlockStore, error) {
+	return openBlockStore(dir, blockSize, masterKey)
+}
+
+func openBlockStore(dir string, blockSize int, key [32]byte) (*BlockStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create block dir: %w", err)
+	}
+
+	return &BlockStore{
+		dir:       dir,
+		blockSize: blockSize,
+		masterKey: key,
+		files:     make(map[uint64]*os.File),
+	}, nil
+}
+
+func (bs *BlockStore) MasterKey() [32]byte {
+	return bs.masterKey
+}
+
+func (bs *BlockStore) BlockSize() int {
+	return bs.blockSize
+}
+
+// cipherBlockSize is the on-disk footprint of one sealed block: nonce,
+// plaintext-sized ciphertext, and the AEAD tag.
+func (bs *BlockStore) cipherBlockSize() int64 {
+	return int64(blockNonceSize + bs.blockSize + blockTagSize)
+}
+
+// deriveKey derives a purpose-bound subkey from the filesystem's master
+// key via HKDF, so every consumer (per-inode block keys, the WAL key,
+// ...) gets an independent key without needing its own random secret.
+func deriveKey(masterKey [32]byte, salt []byte, info string) ([]byte, error) {
+	h := hkdf.New(sha256.New, masterKey[:], salt, []byte(info))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(h, key); err != nil {
+		return nil, fmt.Errorf("derive %s key: %w", info, err)
+	}
+
+	return key, nil
+}
+
+// fileKey derives an AEAD key bound to a single inode, so a ciphertext
+// block copied from one file's backing store can't be substituted into
+// another's.
+func fileKey(masterKey [32]byte, inode uint64) ([]byte, error) {
+	var inodeBytes [8]byte
+	binary.BigEndian.PutUint64(inodeBytes[:], inode)
+
+	return deriveKey(masterKey, inodeBytes[:], "x25fs-block-key")
+}
+
+// WALKey derives the key used to seal write-ahead journal records from
+// the same master key that protects file content blocks.
+func WALKey(masterKey [32]byte) ([32]byte, error) {
+	var key [32]byte
+
+	derived, err := deriveKey(masterKey, nil, "x25fs-wal-key")
+	if err != nil {
+		return key, err
+	}
+
+	copy(key[:], derived)
+	return key, nil
+}
+
+func (bs *BlockStore) blockFile(inode uint64) (*os.File, error) {
+	bs.mux.Lock()
+	defer bs.mux.Unlock()
+
+	if f, ok := bs.files[inode]; ok {
+		return f, nil
+	}
+
+	path := filepath.Join(bs.dir, fmt.Sprintf("%d.blk", inode))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open block file: %w", err)
+	}
+
+	bs.files[inode] = f
+	return f, nil
+}
+
+// Close releases every open backing block file. Called once from
+// SaveData, after its final Checkpoint has written the disk image.
+func (bs *BlockStore) Close() error {
+	bs.mux.Lock()
+	defer bs.mux.Unlock()
+
+	var firstErr error
+	for inode, f := range bs.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(bs.files, inode)
+	}
+
+	return firstErr
+}
+
+// Sync fsyncs every currently open block file, so their content is
+// durable on disk independent of anything the WAL records about it.
+// Checkpoint must call this before truncating the journal: the WAL is
+// the only thing standing between a block write and a crash until its
+// content is fsynced, and truncating it without syncing first throws
+// that away while the base snapshot still claims the content exists.
+func (bs *BlockStore) Sync() error {
+	bs.mux.Lock()
+	defer bs.mux.Unlock()
+
+	var firstErr error
+	for _, f := range bs.files {
+		if err := f.Sync(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("sync block file: %w", err)
+		}
+	}
+
+	return firstErr
+}
+
+// Remove deletes an inode's backing block file entirely, used once
+// Nlink drops to zero.
+func (bs *BlockStore) Remove(inode uint64) error {
+	bs.mux.Lock()
+	f, ok := bs.files[inode]
+	if ok {
+		delete(bs.files, inode)
+	}
+	bs.mux.Unlock()
+
+	if ok {
+		_ = f.Close()
+	}
+
+	path := filepath.Join(bs.dir, fmt.Sprintf("%d.blk", inode))
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove block file: %w", err)
+	}
+
+	return nil
+}
+
+// ReadBlock decrypts blockNo of inode's backing file. A block that was
+// never written (a hole - past the end of the backing file, a short
+// sealed range, or an interior gap left by a random-access write that
+// only touched later blocks) comes back as a zero-filled plaintext block
+// rather than an error: a hole has no sealed frame to authenticate, so
+// feeding its zero bytes to gcm.Open would either fail the tag check or,
+// worse, occasionally succeed against the wrong key.
+func (bs *BlockStore) ReadBlock(inode, blockNo uint64) ([]byte, error) {
+	f, err := bs.blockFile(inode)
+	if err != nil {
+		return nil, err
+	}
+
+	hole, err := bs.blockIsHole(f, blockNo)
+	if err != nil {
+		return nil, fmt.Errorf("check block %d hole: %w", blockNo, err)
+	}
+	if hole {
+		return make([]byte, bs.blockSize), nil
+	}
+
+	sealed := make([]byte, blockNonceSize+bs.blockSize+blockTagSize)
+	n, err := f.ReadAt(sealed, int64(blockNo)*bs.cipherBlockSize())
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("read block %d: %w", blockNo, err)
+	}
+
+	// A gap sharing a filesystem block with a written neighbour passes
+	// blockIsHole but reads back as all zeros; a sealed frame carries a
+	// random nonce and tag, so an all-zero frame is treated as a hole too.
+	allZero := true
+	for _, b := range sealed[:n] {
+		if b != 0 {
+			allZero = false
+			break
+		}
+	}
+
+	if n < blockNonceSize+blockTagSize || allZero {
+		return make([]byte, bs.blockSize), nil
+	}
+
+	key, err := fileKey(bs.masterKey, inode)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("new cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("new gcm: %w", err)
+	}
+
+	nonce := sealed[:blockNonceSize]
+	ciphertext := sealed[blockNonceSize:n]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, blockAAD(inode, blockNo))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt block %d: %w", blockNo, err)
+	}
+
+	if len(plaintext) < bs.blockSize {
+		padded := make([]byte, bs.blockSize)
+		copy(padded, plaintext)
+		plaintext = padded
+	}
+
+	return plaintext, nil
+}
+
+// blockIsHole reports whether blockNo's cipher-sized region of inode's
+// backing file has never been written, using SEEK_DATA: if the next byte
+// of actual data is at or past the end of the block's range, a write
+// landed in some other block and this one was left as a sparse gap (the
+// case WriteAt leaves behind when a random-access write only touches
+// later blocks). Filesystems that don't support SEEK_DATA report EINVAL
+// or ENOTSUP; treat those as "no hole" so reads fall back to the
+// pre-existing short-read check instead of misreporting every block.
+func (bs *BlockStore) blockIsHole(f *os.File, blockNo uint64) (bool, error) {
+	cipherBlockSize := bs.cipherBlockSize()
+	start := int64(blockNo) * cipherBlockSize
+
+	dataOffset, err := unix.Seek(int(f.Fd()), start, unix.SEEK_DATA)
+	if err != nil {
+		if errors.Is(err, unix.ENXIO) {
+			return true, nil
+		}
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTSUP) {
+			return false, nil
+		}
+		return false, fmt.Errorf("seek data: %w", err)
+	}
+
+	return dataOffset >= start+cipherBlockSize, nil
+}
+
+// WriteBlock seals plaintext (which must be exactly BlockSize bytes,
+// zero-padded by the caller if it's a partial trailing block) with a
+// fresh nonce and writes it back at blockNo's deterministic offset.
+func (bs *BlockStore) WriteBlock(inode, blockNo uint64, plaintext []byte) error {
+	f, err := bs.blockFile(inode)
+	if err != nil {
+		return err
+	}
+
+	key, err := fileKey(bs.masterKey, inode)
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("new cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("new gcm: %w", err)
+	}
+
+	nonce := make([]byte, blockNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generate nonce: %w", err)
+	}
+
+	ciphertext := gcm.Seal(nil, nonce, plaintext, blockAAD(inode, blockNo))
+
+	sealed := make([]byte, 0, blockNonceSize+len(ciphertext))
+	sealed = append(sealed, nonce...)
+	sealed = append(sealed, ciphertext...)
+
+	if _, err := f.WriteAt(sealed, int64(blockNo)*bs.cipherBlockSize()); err != nil {
+		return fmt.Errorf("write block %d: %w", blockNo, err)
+	}
+
+	return nil
+}
+
+// Truncate resizes the backing file to hold exactly blockCount blocks,
+// dropping anything beyond that (used on file shrink; deletion goes
+// through Remove).
+func (bs *BlockStore) Truncate(inode, blockCount uint64) error {
+	f, err := bs.blockFile(inode)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Truncate(int64(blockCount) * bs.cipherBlockSize()); err != nil {
+		return fmt.Errorf("truncate block file: %w", err)
+	}
+
+	return nil
+}
+
+// SeekHoleData answers SEEK_DATA/SEEK_HOLE (whence is the raw Linux
+// lseek(2) value: 3 for SEEK_DATA, 4 for SEEK_HOLE) for inode's backing
+// block file, translated back into the plaintext offset space.
+//
+// Because blockSize-aligned plaintext blocks map 1:1 onto
+// cipherBlockSize-aligned regions of the backing file, and Write only
+// ever touches the blocks a request's byte range actually covers (see
+// File.writeRangeLocked), any block a file was never written to is a
+// genuine sparse gap in the backing file on disk - so the plaintext
+// file's own holes can be found by asking the filesystem about the
+// ciphertext file's holes and scaling the answer, without maintaining a
+// separate extent list.
+func (bs *BlockStore) SeekHoleData(inode uint64, offset int64, whence int) (int64, error) {
+	f, err := bs.blockFile(inode)
+	if err != nil {
+		return 0, err
+	}
+
+	cipherBlockSize := bs.cipherBlockSize()
+	cipherOffset := (offset / int64(bs.blockSize)) * cipherBlockSize
+
+	result, err := unix.Seek(int(f.Fd()), cipherOffset, whence)
+	if err != nil {
+		return 0, err
+	}
+
+	return (result / cipherBlockSize) * int64(bs.blockSize), nil
+}
+
+// blockAAD binds a sealed block to both the inode and its position, so
+// blocks can't be reordered or moved between files undetected.
+func blockAAD(inode, blockNo uint64) []byte {
+	aad := make([]byte, 16)
+	binary.BigEndian.PutUint64(aad[:8], inode)
+	binary.BigEndian.PutUint64(aad[8:], blockNo)
+	return aad
+}
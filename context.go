@@ -0,0 +1,40 @@
+/*
+ * Copyright 2025 Nathanne Isip
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"github.com/nthnn/x25fs/journal"
+	"github.com/nthnn/xbin25"
+)
+
+// FSContext carries the state that every node in the tree needs but that
+// doesn't belong on the node itself: the whole-disk encryption config,
+// the per-file block store backing on-disk content, the (optional)
+// content-addressable dedup store that replaces it when -dedup is set,
+// and (optionally) the write-ahead journal that makes mutations
+// crash-consistent.
+//
+// A single FSContext is shared (by pointer) across every Dir and File in
+// a mounted tree, the same way *xbin25.XBin25Config used to be handed
+// around before block-based storage existed.
+type FSContext struct {
+	Config  *xbin25.XBin25Config
+	Blocks  *BlockStore
+	Dedup   *DedupStore
+	Journal *journal.Journal
+}
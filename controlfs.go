@@ -0,0 +1,123 @@
+/*
+ * Copyright 2025 Nathanne Isip
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// controlDirName is the virtual top-level directory exposing filesystem
+// introspection files. It isn't a real directory entry - Dir.Lookup and
+// Dir.ReadDirAll special-case it only at the true filesystem root (inode
+// 1), the same way /proc exposes kernel state through a normal-looking
+// directory that isn't backed by disk.
+const controlDirName = ".x25fs"
+
+const rootHashFileName = "root-hash"
+
+// controlInode and rootHashInode are fixed sentinel inode numbers, kept
+// out of the real inode counter's range so they never collide with an
+// actual file or directory.
+const (
+	controlInode  = ^uint64(0) - 1
+	rootHashInode = ^uint64(0)
+)
+
+// controlDir is the virtual ".x25fs" directory. It has exactly one entry,
+// "root-hash", computed fresh on every read rather than stored.
+type controlDir struct {
+	root *Dir
+}
+
+func (cd *controlDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	*attr = fuse.Attr{
+		Inode: controlInode,
+		Mode:  os.ModeDir | 0o555,
+		Nlink: 1,
+	}
+	return nil
+}
+
+func (cd *controlDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if name != rootHashFileName {
+		return nil, syscall.ENOENT
+	}
+
+	return &rootHashFile{root: cd.root}, nil
+}
+
+func (cd *controlDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{{
+		Inode: rootHashInode,
+		Name:  rootHashFileName,
+		Type:  fuse.DT_File,
+	}}, nil
+}
+
+// rootHashFile is a read-only virtual file whose content is the current
+// Merkle root hash (see computeTreeHash) of the whole tree, hex-encoded,
+// recomputed on every read rather than cached.
+type rootHashFile struct {
+	root *Dir
+}
+
+func (rf *rootHashFile) Attr(ctx context.Context, attr *fuse.Attr) error {
+	*attr = fuse.Attr{
+		Inode: rootHashInode,
+		Mode:  0o444,
+		Nlink: 1,
+		Size:  uint64(hex.EncodedLen(32) + 1),
+	}
+	return nil
+}
+
+func (rf *rootHashFile) Open(
+	ctx context.Context,
+	req *fuse.OpenRequest,
+	res *fuse.OpenResponse,
+) (fs.Handle, error) {
+	return rf, nil
+}
+
+func (rf *rootHashFile) Read(
+	ctx context.Context,
+	req *fuse.ReadRequest,
+	res *fuse.ReadResponse,
+) error {
+	hash := computeTreeHash(rf.root)
+	content := append([]byte(hex.EncodeToString(hash[:])), '\n')
+
+	if req.Offset >= int64(len(content)) {
+		res.Data = []byte{}
+		return nil
+	}
+
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(content)) {
+		end = int64(len(content))
+	}
+
+	res.Data = content[req.Offset:end]
+	return nil
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright 2025 Nathanne Isip
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// BlockRef tracks how many files currently reference a content-addressed
+// block, so the underlying ciphertext is only reclaimed once nothing
+// points at it anymore.
+type BlockRef struct {
+	RefCount int
+}
+
+// DedupStore is the content-addressable counterpart to BlockStore: blocks
+// are named by the SHA-256 of their plaintext rather than by (inode,
+// blockNo), so identical blocks written by different files - or the same
+// file more than once - share a single sealed copy on disk.
+type DedupStore struct {
+	dir       string
+	blockSize int
+	key       [32]byte
+
+	mux  sync.Mutex
+	refs map[[32]byte]*BlockRef
+}
+
+// NewDedupStore opens (creating if necessary) the content-addressable
+// block directory rooted at dir, keyed off the filesystem's master key.
+func NewDedupStore(dir string, blockSize int, masterKey [32]byte) (*DedupStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create dedup dir: %w", err)
+	}
+
+	key, err := deriveKey(masterKey, nil, "x25fs-dedup-key")
+	if err != nil {
+		return nil, err
+	}
+
+	var fixedKey [32]byte
+	copy(fixedKey[:], key)
+
+	return &DedupStore{
+		dir:       dir,
+		blockSize: blockSize,
+		key:       fixedKey,
+		refs:      make(map[[32]byte]*BlockRef),
+	}, nil
+}
+
+func (ds *DedupStore) BlockSize() int {
+	return ds.blockSize
+}
+
+func (ds *DedupStore) path(hash [32]byte) string {
+	return filepath.Join(ds.dir, hex.EncodeToString(hash[:])+".blk")
+}
+
+// HashBlock is the identity function this whole store is keyed by:
+// SHA-256 of the plaintext block content.
+func HashBlock(plaintext []byte) [32]byte {
+	return sha256.Sum256(plaintext)
+}
+
+// Acquire records a new reference to hash, sealing and writing plaintext
+// to disk the first time it's seen and just bumping the refcount on
+// every subsequent call - that refcount bump is the dedup.
+func (ds *DedupStore) Acquire(hash [32]byte, plaintext []byte) error {
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+
+	if ref, ok := ds.refs[hash]; ok {
+		ref.RefCount++
+		return nil
+	}
+
+	if err := ds.sealAndWrite(hash, plaintext); err != nil {
+		return err
+	}
+
+	ds.refs[hash] = &BlockRef{RefCount: 1}
+	return nil
+}
+
+// ZeroHash is the content hash every all-zero block shares. It's exposed
+// so callers can recognize a hole block by its hash alone, without the
+// refcount side effect of AcquireZeroBlock.
+func (ds *DedupStore) ZeroHash() [32]byte {
+	return HashBlock(make([]byte, ds.blockSize))
+}
+
+// AcquireZeroBlock is a convenience wrapper for filling sparse gaps: every
+// hole block shares the same all-zero content, so it dedups to a single
+// block file regardless of how many files or how much of a file is
+// sparse.
+func (ds *DedupStore) AcquireZeroBlock() ([32]byte, error) {
+	hash := ds.ZeroHash()
+
+	if err := ds.Acquire(hash, make([]byte, ds.blockSize)); err != nil {
+		return hash, err
+	}
+
+	return hash, nil
+}
+
+// Release drops one reference to hash, deleting the sealed block once
+// nothing references it anymore.
+func (ds *DedupStore) Release(hash [32]byte) error {
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+
+	ref, ok := ds.refs[hash]
+	if !ok {
+		return nil
+	}
+
+	ref.RefCount--
+	if ref.RefCount > 0 {
+		return nil
+	}
+
+	delete(ds.refs, hash)
+	if err := os.Remove(ds.path(hash)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove dedup block: %w", err)
+	}
+
+	return nil
+}
+
+// AddRef increments hash's refcount without writing anything, used when
+// rebuilding refcounts from an already-persisted tree on load.
+func (ds *DedupStore) AddRef(hash [32]byte) {
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+
+	if ref, ok := ds.refs[hash]; ok {
+		ref.RefCount++
+		return
+	}
+
+	ds.refs[hash] = &BlockRef{RefCount: 1}
+}
+
+// Read decrypts and returns the plaintext block named by hash.
+func (ds *DedupStore) Read(hash [32]byte) ([]byte, error) {
+	sealed, err := os.ReadFile(ds.path(hash))
+	if err != nil {
+		return nil, fmt.Errorf("read dedup block: %w", err)
+	}
+
+	if len(sealed) < blockNonceSize+blockTagSize {
+		return nil, fmt.Errorf("truncated dedup block")
+	}
+
+	block, err := aes.NewCipher(ds.key[:])
+	if err != nil {
+		return nil, fmt.Errorf("new cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("new gcm: %w", err)
+	}
+
+	nonce := sealed[:blockNonceSize]
+	ciphertext := sealed[blockNonceSize:]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, hash[:])
+	if err != nil {
+		return nil, fmt.Errorf("decrypt dedup block: %w", err)
+	}
+
+	if len(plaintext) < ds.blockSize {
+		padded := make([]byte, ds.blockSize)
+		copy(padded, plaintext)
+		plaintext = padded
+	}
+
+	return plaintext, nil
+}
+
+func (ds *DedupStore) sealAndWrite(hash [32]byte, plaintext []byte) error {
+	block, err := aes.NewCipher(ds.key[:])
+	if err != nil {
+		return fmt.Errorf("new cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("new gcm: %w", err)
+	}
+
+	nonce := make([]byte, blockNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generate nonce: %w", err)
+	}
+
+	padded := plaintext
+	if len(padded) < ds.blockSize {
+		padded = make([]byte, ds.blockSize)
+		copy(padded, plaintext)
+	}
+
+	ciphertext := gcm.Seal(nil, nonce, padded, hash[:])
+
+	sealed := make([]byte, 0, blockNonceSize+len(ciphertext))
+	sealed = append(sealed, nonce...)
+	sealed = append(sealed, ciphertext...)
+
+	if err := os.WriteFile(ds.path(hash), sealed, 0o600); err != nil {
+		return fmt.Errorf("write dedup block: %w", err)
+	}
+
+	return nil
+}
+
+// RebuildRefs recomputes every block's refcount from the tree already
+// deserialized from disk. Refcounts live only in memory, so they have to
+// be reconstructed this way once per mount rather than persisted. A
+// hard-linked *File is reachable under every name that points at it, so
+// inodes already visited are skipped - the same dedup-by-inode rule
+// GetTotalInodes uses - or its blocks would be ref'd once per link and
+// never reach zero on delete.
+func RebuildRefs(root *Dir) {
+	seen := make(map[uint64]struct{})
+	rebuildRefs(root, seen)
+}
+
+func rebuildRefs(dir *Dir, seen map[uint64]struct{}) {
+	dir.Mux.RLock()
+	defer dir.Mux.RUnlock()
+
+	for _, node := range dir.Children {
+		switch n := node.(type) {
+		case *Dir:
+			rebuildRefs(n, seen)
+		case *File:
+			if _, ok := seen[n.Attributes.Inode]; ok {
+				continue
+			}
+			seen[n.Attributes.Inode] = struct{}{}
+
+			if n.Context != nil && n.Context.Dedup != nil {
+				for _, hash := range n.BlockHashes {
+					n.Context.Dedup.AddRef(hash)
+				}
+			}
+		}
+	}
+}
@@ -19,6 +19,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
@@ -27,14 +28,16 @@ import (
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"github.com/nthnn/xbin25"
+	"github.com/nthnn/x25fs/journal"
+	"github.com/nthnn/x25fs/trace"
 )
 
 type Dir struct {
 	Mux        sync.RWMutex
 	Attributes fuse.Attr
 	Children   map[string]fs.Node
-	Config     *xbin25.XBin25Config
+	Context    *FSContext
+	Xattrs     map[string][]byte
 }
 
 func (directory *Dir) Attr(
@@ -59,10 +62,33 @@ func (directory *Dir) Setattr(
 	ctx context.Context,
 	req *fuse.SetattrRequest,
 	resp *fuse.SetattrResponse,
-) error {
+) (err error) {
+	finish := trace.Start("Dir.Setattr", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", directory.Attributes.Inode),
+				fmt.Sprintf("valid=%v", req.Valid)
+		})
+	defer func() { finish(err) }()
+
 	directory.Mux.RLock()
 	defer directory.Mux.RUnlock()
 
+	if err := appendJournal(directory.Context, journal.OpSetattr, journalSetattrPayload{
+		Inode:      directory.Attributes.Inode,
+		ValidMode:  req.Valid.Mode(),
+		ValidUid:   req.Valid.Uid(),
+		ValidGid:   req.Valid.Gid(),
+		ValidAtime: req.Valid.Atime(),
+		ValidMtime: req.Valid.Mtime(),
+		Mode:       req.Mode,
+		Uid:        req.Uid,
+		Gid:        req.Gid,
+		Atime:      req.Atime,
+		Mtime:      req.Mtime,
+	}); err != nil {
+		return err
+	}
+
 	if req.Valid.Mode() {
 		directory.Attributes.Mode = req.Mode
 	}
@@ -91,7 +117,13 @@ func (directory *Dir) Getattr(
 	ctx context.Context,
 	req *fuse.GetattrRequest,
 	resp *fuse.GetattrResponse,
-) error {
+) (err error) {
+	finish := trace.Start("Dir.Getattr", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", directory.Attributes.Inode), ""
+		})
+	defer func() { finish(err) }()
+
 	directory.Mux.RLock()
 	defer directory.Mux.RUnlock()
 
@@ -102,10 +134,20 @@ func (directory *Dir) Getattr(
 func (directory *Dir) Lookup(
 	ctx context.Context,
 	name string,
-) (fs.Node, error) {
+) (node fs.Node, err error) {
+	// fs.NodeStringLookuper doesn't hand Lookup a *fuse.Request, so there's
+	// no Header to pull uid/gid/pid from here; recorded as 0/0/0 rather
+	// than guessed.
+	finish := trace.Start("Dir.Lookup", 0, 0, 0, func() (string, string) { return name, "" })
+	defer func() { finish(err) }()
+
 	directory.Mux.RLock()
 	defer directory.Mux.RUnlock()
 
+	if directory.Attributes.Inode == 1 && name == controlDirName {
+		return &controlDir{root: directory}, nil
+	}
+
 	if child, ok := directory.Children[name]; ok {
 		return child, nil
 	}
@@ -117,7 +159,11 @@ func (directory *Dir) Create(
 	ctx context.Context,
 	req *fuse.CreateRequest,
 	res *fuse.CreateResponse,
-) (fs.Node, fs.Handle, error) {
+) (node fs.Node, handle fs.Handle, err error) {
+	finish := trace.Start("Dir.Create", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) { return req.Name, fmt.Sprintf("mode=%v", req.Mode) })
+	defer func() { finish(err) }()
+
 	directory.Mux.Lock()
 	defer directory.Mux.Unlock()
 
@@ -172,8 +218,21 @@ func (directory *Dir) Create(
 			Ctime: now,
 			Uid:   req.Header.Uid,
 			Gid:   req.Header.Gid,
+			Nlink: 1,
 		},
-		Data: []byte{},
+		Context: directory.Context,
+	}
+
+	if err := appendJournal(directory.Context, journal.OpCreate, journalCreatePayload{
+		ParentInode: directory.Attributes.Inode,
+		Name:        name,
+		Inode:       file.Attributes.Inode,
+		Mode:        file.Attributes.Mode,
+		Uid:         file.Attributes.Uid,
+		Gid:         file.Attributes.Gid,
+		CreatedAt:   now,
+	}); err != nil {
+		return nil, nil, err
 	}
 
 	directory.Children[name] = file
@@ -186,7 +245,11 @@ func (directory *Dir) Create(
 func (directory *Dir) Mkdir(
 	ctx context.Context,
 	req *fuse.MkdirRequest,
-) (fs.Node, error) {
+) (node fs.Node, err error) {
+	finish := trace.Start("Dir.Mkdir", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) { return req.Name, fmt.Sprintf("mode=%v", req.Mode) })
+	defer func() { finish(err) }()
+
 	directory.Mux.Lock()
 	defer directory.Mux.Unlock()
 
@@ -221,7 +284,19 @@ func (directory *Dir) Mkdir(
 			Gid:   req.Header.Gid,
 		},
 		Children: make(map[string]fs.Node),
-		Config:   directory.Config,
+		Context:  directory.Context,
+	}
+
+	if err := appendJournal(directory.Context, journal.OpMkdir, journalMkdirPayload{
+		ParentInode: directory.Attributes.Inode,
+		Name:        name,
+		Inode:       dir.Attributes.Inode,
+		Mode:        dir.Attributes.Mode,
+		Uid:         dir.Attributes.Uid,
+		Gid:         dir.Attributes.Gid,
+		CreatedAt:   now,
+	}); err != nil {
+		return nil, err
 	}
 
 	directory.Children[name] = dir
@@ -231,13 +306,128 @@ func (directory *Dir) Mkdir(
 	return dir, nil
 }
 
+func (directory *Dir) Symlink(
+	ctx context.Context,
+	req *fuse.SymlinkRequest,
+) (node fs.Node, err error) {
+	finish := trace.Start("Dir.Symlink", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) { return req.NewName, fmt.Sprintf("target=%s", req.Target) })
+	defer func() { finish(err) }()
+
+	directory.Mux.Lock()
+	defer directory.Mux.Unlock()
+
+	name := req.NewName
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	if _, exists := directory.Children[name]; exists {
+		return nil, syscall.EEXIST
+	}
+
+	if !hasWritePermission(req.Header.Uid, req.Header.Gid, directory.Attributes) {
+		return nil, syscall.EACCES
+	}
+
+	now := time.Now()
+	link := &Symlink{
+		Attributes: fuse.Attr{
+			Inode: GetInodeAndIncrease(),
+			Mode:  os.ModeSymlink | 0777,
+			Size:  uint64(len(req.Target)),
+			Nlink: 1,
+			Atime: now,
+			Mtime: now,
+			Ctime: now,
+			Uid:   req.Header.Uid,
+			Gid:   req.Header.Gid,
+		},
+		Target: req.Target,
+	}
+
+	if err := appendJournal(directory.Context, journal.OpSymlink, journalSymlinkPayload{
+		ParentInode: directory.Attributes.Inode,
+		Name:        name,
+		Inode:       link.Attributes.Inode,
+		Target:      req.Target,
+		Uid:         link.Attributes.Uid,
+		Gid:         link.Attributes.Gid,
+	}); err != nil {
+		return nil, err
+	}
+
+	directory.Children[name] = link
+	directory.Attributes.Mtime = now
+	directory.Attributes.Ctime = now
+
+	return link, nil
+}
+
+func (directory *Dir) Link(
+	ctx context.Context,
+	req *fuse.LinkRequest,
+	old fs.Node,
+) (node fs.Node, err error) {
+	finish := trace.Start("Dir.Link", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) { return req.NewName, "" })
+	defer func() { finish(err) }()
+
+	file, ok := old.(*File)
+	if !ok {
+		return nil, syscall.EPERM
+	}
+
+	directory.Mux.Lock()
+	defer directory.Mux.Unlock()
+
+	name := req.NewName
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	if _, exists := directory.Children[name]; exists {
+		return nil, syscall.EEXIST
+	}
+
+	if !hasWritePermission(req.Header.Uid, req.Header.Gid, directory.Attributes) {
+		return nil, syscall.EACCES
+	}
+
+	if err := appendJournal(directory.Context, journal.OpLink, journalLinkPayload{
+		ParentInode: directory.Attributes.Inode,
+		Name:        name,
+		Inode:       file.Attributes.Inode,
+	}); err != nil {
+		return nil, err
+	}
+
+	file.Mux.Lock()
+	file.Attributes.Nlink++
+	file.Attributes.Ctime = time.Now()
+	file.Mux.Unlock()
+
+	directory.Children[name] = file
+	now := time.Now()
+	directory.Attributes.Mtime = now
+	directory.Attributes.Ctime = now
+
+	return file, nil
+}
+
 func (directory *Dir) ReadDirAll(
 	ctx context.Context,
-) ([]fuse.Dirent, error) {
+) (entries []fuse.Dirent, err error) {
+	// No *fuse.Request reaches ReadDirAll either; see Lookup above.
+	finish := trace.Start("Dir.ReadDirAll", 0, 0, 0,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", directory.Attributes.Inode), ""
+		})
+	defer func() { finish(err) }()
+
 	directory.Mux.RLock()
 	defer directory.Mux.RUnlock()
 
-	var entries []fuse.Dirent
 	for name, node := range directory.Children {
 		var typ fuse.DirentType
 
@@ -246,6 +436,8 @@ func (directory *Dir) ReadDirAll(
 			typ = fuse.DT_Dir
 		case *File:
 			typ = fuse.DT_File
+		case *Symlink:
+			typ = fuse.DT_Link
 		}
 
 		entries = append(entries, fuse.Dirent{
@@ -255,13 +447,25 @@ func (directory *Dir) ReadDirAll(
 		})
 	}
 
+	if directory.Attributes.Inode == 1 {
+		entries = append(entries, fuse.Dirent{
+			Inode: controlInode,
+			Name:  controlDirName,
+			Type:  fuse.DT_Dir,
+		})
+	}
+
 	return entries, nil
 }
 
 func (directory *Dir) Remove(
 	ctx context.Context,
 	req *fuse.RemoveRequest,
-) error {
+) (err error) {
+	finish := trace.Start("Dir.Remove", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) { return req.Name, fmt.Sprintf("dir=%v", req.Dir) })
+	defer func() { finish(err) }()
+
 	directory.Mux.Lock()
 	defer directory.Mux.Unlock()
 
@@ -270,7 +474,8 @@ func (directory *Dir) Remove(
 		return err
 	}
 
-	if _, exists := directory.Children[name]; !exists {
+	child, exists := directory.Children[name]
+	if !exists {
 		return syscall.ENOENT
 	}
 
@@ -282,10 +487,52 @@ func (directory *Dir) Remove(
 		return syscall.EPERM
 	}
 
+	if err := appendJournal(directory.Context, journal.OpRemove, journalRemovePayload{
+		ParentInode: directory.Attributes.Inode,
+		Name:        name,
+	}); err != nil {
+		return err
+	}
+
 	delete(directory.Children, name)
 	directory.Attributes.Mtime = time.Now()
 	directory.Attributes.Ctime = time.Now()
 
+	if file, ok := child.(*File); ok {
+		if err := dropFileLink(directory.Context, file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dropFileLink decrements file's Nlink for one directory entry that no
+// longer points at it, releasing its backing storage once the count
+// hits zero. Shared by Remove and Rename (the latter for a rename's
+// overwritten target) so both paths reclaim storage the same way.
+func dropFileLink(ctx *FSContext, file *File) error {
+	file.Mux.Lock()
+	file.Attributes.Nlink--
+	nlink := file.Attributes.Nlink
+	file.Mux.Unlock()
+
+	if nlink != 0 {
+		return nil
+	}
+
+	if file.dedupEnabled() {
+		for _, hash := range file.BlockHashes {
+			if err := ctx.Dedup.Release(hash); err != nil {
+				return err
+			}
+		}
+	} else if ctx != nil && ctx.Blocks != nil {
+		if err := ctx.Blocks.Remove(file.Attributes.Inode); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -293,7 +540,11 @@ func (directory *Dir) Rename(
 	ctx context.Context,
 	req *fuse.RenameRequest,
 	newDir fs.Node,
-) error {
+) (err error) {
+	finish := trace.Start("Dir.Rename", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) { return req.OldName, fmt.Sprintf("-> %s", req.NewName) })
+	defer func() { finish(err) }()
+
 	if req.NewName != filepath.Base(req.NewName) ||
 		req.NewName == ".." || req.NewName == "." {
 		return syscall.EINVAL
@@ -338,6 +589,23 @@ func (directory *Dir) Rename(
 		return syscall.ENOENT
 	}
 
+	if err := appendJournal(directory.Context, journal.OpRename, journalRenamePayload{
+		OldParentInode: directory.Attributes.Inode,
+		NewParentInode: targetDir.Attributes.Inode,
+		OldName:        req.OldName,
+		NewName:        req.NewName,
+	}); err != nil {
+		return err
+	}
+
+	if victim, overwritten := targetDir.Children[req.NewName]; overwritten {
+		if victimFile, ok := victim.(*File); ok {
+			if err := dropFileLink(targetDir.Context, victimFile); err != nil {
+				return err
+			}
+		}
+	}
+
 	delete(targetDir.Children, req.NewName)
 	delete(directory.Children, req.OldName)
 	targetDir.Children[req.NewName] = child
@@ -351,3 +619,124 @@ func (directory *Dir) Rename(
 
 	return nil
 }
+
+func (directory *Dir) Getxattr(
+	ctx context.Context,
+	req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse,
+) (err error) {
+	finish := trace.Start("Dir.Getxattr", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", directory.Attributes.Inode), req.Name
+		})
+	defer func() { finish(err) }()
+
+	directory.Mux.RLock()
+	defer directory.Mux.RUnlock()
+
+	value, ok := directory.Xattrs[req.Name]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+
+	if req.Size != 0 && uint32(len(value)) > req.Size {
+		return syscall.ERANGE
+	}
+
+	resp.Xattr = value
+	return nil
+}
+
+func (directory *Dir) Listxattr(
+	ctx context.Context,
+	req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse,
+) (err error) {
+	finish := trace.Start("Dir.Listxattr", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", directory.Attributes.Inode), ""
+		})
+	defer func() { finish(err) }()
+
+	directory.Mux.RLock()
+	defer directory.Mux.RUnlock()
+
+	for name := range directory.Xattrs {
+		resp.Append(name)
+	}
+
+	return nil
+}
+
+func (directory *Dir) Setxattr(
+	ctx context.Context,
+	req *fuse.SetxattrRequest,
+) (err error) {
+	finish := trace.Start("Dir.Setxattr", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", directory.Attributes.Inode), req.Name
+		})
+	defer func() { finish(err) }()
+
+	directory.Mux.Lock()
+	defer directory.Mux.Unlock()
+
+	if !hasWritePermission(req.Header.Uid, req.Header.Gid, directory.Attributes) {
+		return syscall.EACCES
+	}
+
+	if err := checkSetxattr(req.Name, req.Xattr, directory.Xattrs); err != nil {
+		return err
+	}
+
+	if err := appendJournal(directory.Context, journal.OpXattrSet, journalXattrSetPayload{
+		Inode: directory.Attributes.Inode,
+		Name:  req.Name,
+		Value: req.Xattr,
+	}); err != nil {
+		return err
+	}
+
+	if directory.Xattrs == nil {
+		directory.Xattrs = make(map[string][]byte)
+	}
+
+	directory.Xattrs[req.Name] = append([]byte(nil), req.Xattr...)
+	directory.Attributes.Ctime = time.Now()
+
+	return nil
+}
+
+func (directory *Dir) Removexattr(
+	ctx context.Context,
+	req *fuse.RemovexattrRequest,
+) (err error) {
+	finish := trace.Start("Dir.Removexattr", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", directory.Attributes.Inode), req.Name
+		})
+	defer func() { finish(err) }()
+
+	directory.Mux.Lock()
+	defer directory.Mux.Unlock()
+
+	if !hasWritePermission(req.Header.Uid, req.Header.Gid, directory.Attributes) {
+		return syscall.EACCES
+	}
+
+	if _, ok := directory.Xattrs[req.Name]; !ok {
+		return fuse.ErrNoXattr
+	}
+
+	if err := appendJournal(directory.Context, journal.OpXattrRemove, journalXattrRemovePayload{
+		Inode: directory.Attributes.Inode,
+		Name:  req.Name,
+	}); err != nil {
+		return err
+	}
+
+	delete(directory.Xattrs, req.Name)
+	directory.Attributes.Ctime = time.Now()
+
+	return nil
+}
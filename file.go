@@ -19,18 +19,34 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"syscall"
 	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"github.com/nthnn/x25fs/journal"
+	"github.com/nthnn/x25fs/trace"
 )
 
+// File is backed by a BlockStore rather than an in-memory buffer: content
+// lives on disk as independently AEAD-sealed fixed-size blocks, and only
+// the blocks a given Read/Write touches are ever decrypted into RAM.
+//
+// When Context.Dedup is set, content addressing replaces per-inode block
+// storage: BlockHashes names the file's full blocks by the SHA-256 of
+// their plaintext in the shared DedupStore, and Tail holds the trailing
+// partial block privately, since it can't be shared without letting a
+// truncation of one file corrupt another's data.
 type File struct {
 	Mux        sync.RWMutex
 	Attributes fuse.Attr
-	Data       []byte
+	Context    *FSContext
+	Xattrs     map[string][]byte
+
+	BlockHashes [][32]byte
+	Tail        []byte
 }
 
 const MAX_FILE_SIZE = 536870912
@@ -47,10 +63,35 @@ func (file *File) Setattr(
 	ctx context.Context,
 	req *fuse.SetattrRequest,
 	res *fuse.SetattrResponse,
-) error {
+) (err error) {
+	finish := trace.Start("File.Setattr", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", file.Attributes.Inode),
+				fmt.Sprintf("valid=%v", req.Valid)
+		})
+	defer func() { finish(err) }()
+
 	file.Mux.Lock()
 	defer file.Mux.Unlock()
 
+	if err := appendJournal(file.Context, journal.OpSetattr, journalSetattrPayload{
+		Inode:      file.Attributes.Inode,
+		ValidMode:  req.Valid.Mode(),
+		ValidUid:   req.Valid.Uid(),
+		ValidGid:   req.Valid.Gid(),
+		ValidAtime: req.Valid.Atime(),
+		ValidMtime: req.Valid.Mtime(),
+		ValidSize:  req.Valid.Size(),
+		Mode:       req.Mode,
+		Uid:        req.Uid,
+		Gid:        req.Gid,
+		Atime:      req.Atime,
+		Mtime:      req.Mtime,
+		Size:       req.Size,
+	}); err != nil {
+		return err
+	}
+
 	if req.Valid.Mode() {
 		file.Attributes.Mode = req.Mode
 	}
@@ -72,23 +113,20 @@ func (file *File) Setattr(
 	}
 
 	if req.Valid.Size() {
-		currentSize := len(file.Data)
-		newSize := int(req.Size)
+		currentSize := file.Attributes.Size
+		newSize := req.Size
+
+		if newSize > MAX_FILE_SIZE {
+			return syscall.EFBIG
+		}
 
 		if newSize < currentSize {
-			file.Data = file.Data[:newSize]
-		} else if newSize > currentSize {
-			if newSize > MAX_FILE_SIZE {
-				return syscall.EFBIG
+			if err := file.shrinkLocked(newSize); err != nil {
+				return err
 			}
-
-			newData := make([]byte, newSize)
-			copy(newData, file.Data)
-
-			file.Data = newData
 		}
 
-		file.Attributes.Size = req.Size
+		file.Attributes.Size = newSize
 		file.Attributes.Mtime = time.Now()
 	}
 
@@ -100,7 +138,13 @@ func (file *File) Getattr(
 	ctx context.Context,
 	req *fuse.GetattrRequest,
 	resp *fuse.GetattrResponse,
-) error {
+) (err error) {
+	finish := trace.Start("File.Getattr", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", file.Attributes.Inode), ""
+		})
+	defer func() { finish(err) }()
+
 	file.Mux.RLock()
 	defer file.Mux.RUnlock()
 
@@ -108,6 +152,199 @@ func (file *File) Getattr(
 	return nil
 }
 
+// blockSize returns the configured plaintext block size for this
+// filesystem, falling back to the default for files created before a
+// Context was wired up.
+func (file *File) blockSize() int {
+	if file.Context == nil || file.Context.Blocks == nil {
+		return DEFAULT_FILE_BLOCK_SIZE
+	}
+
+	return file.Context.Blocks.BlockSize()
+}
+
+// dedupEnabled reports whether this file's content is stored as
+// content-addressed block references rather than in the per-inode
+// BlockStore.
+func (file *File) dedupEnabled() bool {
+	return file.Context != nil && file.Context.Dedup != nil
+}
+
+// shrinkLocked truncates the backing storage to newSize, zeroing the tail
+// of the new last block so a later grow doesn't resurface old data.
+// Callers must hold file.Mux.
+func (file *File) shrinkLocked(newSize uint64) error {
+	if file.dedupEnabled() {
+		return file.shrinkDedupLocked(newSize)
+	}
+
+	bs := file.Context.Blocks
+	bSize := uint64(file.blockSize())
+	inode := file.Attributes.Inode
+
+	if newSize == 0 {
+		return bs.Truncate(inode, 0)
+	}
+
+	lastBlock := (newSize - 1) / bSize
+	offsetInBlock := newSize - lastBlock*bSize
+
+	plaintext, err := bs.ReadBlock(inode, lastBlock)
+	if err != nil {
+		return err
+	}
+
+	for i := int(offsetInBlock); i < len(plaintext); i++ {
+		plaintext[i] = 0
+	}
+
+	if err := bs.WriteBlock(inode, lastBlock, plaintext); err != nil {
+		return err
+	}
+
+	return bs.Truncate(inode, lastBlock+1)
+}
+
+// shrinkDedupLocked releases every full block beyond newSize and copies
+// whatever remains of the new last block into a private Tail, since a
+// dedup'd block can't be edited in place without corrupting every other
+// file that shares it.
+func (file *File) shrinkDedupLocked(newSize uint64) error {
+	dedup := file.Context.Dedup
+	bSize := uint64(file.blockSize())
+
+	if newSize == 0 {
+		for _, hash := range file.BlockHashes {
+			if err := dedup.Release(hash); err != nil {
+				return err
+			}
+		}
+
+		file.BlockHashes = nil
+		file.Tail = nil
+		return nil
+	}
+
+	lastBlock := (newSize - 1) / bSize
+	tailLen := newSize - lastBlock*bSize
+
+	if lastBlock < uint64(len(file.BlockHashes)) {
+		content, err := dedup.Read(file.BlockHashes[lastBlock])
+		if err != nil {
+			return err
+		}
+
+		for i := lastBlock; i < uint64(len(file.BlockHashes)); i++ {
+			if err := dedup.Release(file.BlockHashes[i]); err != nil {
+				return err
+			}
+		}
+
+		file.BlockHashes = file.BlockHashes[:lastBlock]
+		file.Tail = append([]byte(nil), content[:tailLen]...)
+		return nil
+	}
+
+	// Tail occupies the slot at len(BlockHashes); only cut it when that
+	// slot is the new last block; otherwise it lies wholly below newSize.
+	if lastBlock == uint64(len(file.BlockHashes)) && uint64(len(file.Tail)) > tailLen {
+		file.Tail = file.Tail[:tailLen]
+	}
+
+	return nil
+}
+
+// blockAtLocked returns the current plaintext content of blockNo as a
+// full block-sized buffer, reconstructed from a dedup'd full block, the
+// private Tail, or a zero-filled hole. Callers must hold file.Mux.
+func (file *File) blockAtLocked(blockNo uint64) ([]byte, error) {
+	bSize := uint64(file.blockSize())
+
+	if blockNo < uint64(len(file.BlockHashes)) {
+		return file.Context.Dedup.Read(file.BlockHashes[blockNo])
+	}
+
+	block := make([]byte, bSize)
+	if blockNo == uint64(len(file.BlockHashes)) {
+		copy(block, file.Tail)
+	}
+
+	return block, nil
+}
+
+// setBlockLocked stores plaintext (a full block-sized buffer) as the new
+// content of blockNo. Blocks at or before the current end are dedup'd
+// eagerly; writing past the current end first promotes whatever's in
+// Tail to a real dedup'd block (it occupies the slot at the current
+// length, so skipping this would silently drop it), fills the rest of
+// the gap with shared all-zero blocks so sparse growth stays cheap, then
+// keeps the final written block as a private Tail rather than dedup'ing
+// it, since the common case - sequential appends - would otherwise
+// promote and immediately re-release the same trailing block on every
+// call.
+func (file *File) setBlockLocked(blockNo uint64, plaintext []byte, isFinalBlock bool) error {
+	dedup := file.Context.Dedup
+	bSize := uint64(file.blockSize())
+
+	if blockNo < uint64(len(file.BlockHashes)) {
+		oldHash := file.BlockHashes[blockNo]
+		hash := HashBlock(plaintext)
+		if hash == oldHash {
+			return nil
+		}
+
+		if err := dedup.Acquire(hash, plaintext); err != nil {
+			return err
+		}
+		if err := dedup.Release(oldHash); err != nil {
+			return err
+		}
+
+		file.BlockHashes[blockNo] = hash
+		return nil
+	}
+
+	if blockNo > uint64(len(file.BlockHashes)) {
+		// The slot at the current length doesn't hold a zero block yet -
+		// it holds whatever's in Tail. Promote it to a real dedup'd block
+		// before gap-filling past it, or the zero-fill below would
+		// silently overwrite that data instead of the hole after it.
+		tailBlock := make([]byte, bSize)
+		copy(tailBlock, file.Tail)
+
+		tailHash := HashBlock(tailBlock)
+		if err := dedup.Acquire(tailHash, tailBlock); err != nil {
+			return err
+		}
+
+		file.BlockHashes = append(file.BlockHashes, tailHash)
+		file.Tail = nil
+	}
+
+	for uint64(len(file.BlockHashes)) < blockNo {
+		zeroHash, err := dedup.AcquireZeroBlock()
+		if err != nil {
+			return err
+		}
+
+		file.BlockHashes = append(file.BlockHashes, zeroHash)
+	}
+
+	if !isFinalBlock {
+		hash := HashBlock(plaintext)
+		if err := dedup.Acquire(hash, plaintext); err != nil {
+			return err
+		}
+
+		file.BlockHashes = append(file.BlockHashes, hash)
+		file.Tail = nil
+		return nil
+	}
+
+	file.Tail = append([]byte(nil), plaintext...)
+	return nil
+}
+
 func (file *File) Open(
 	ctx context.Context,
 	req *fuse.OpenRequest,
@@ -134,31 +371,102 @@ func (file *File) Read(
 	ctx context.Context,
 	req *fuse.ReadRequest,
 	res *fuse.ReadResponse,
-) error {
+) (err error) {
+	finish := trace.Start("File.Read", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", file.Attributes.Inode),
+				fmt.Sprintf("offset=%d size=%d", req.Offset, req.Size)
+		})
+	defer func() { finish(err) }()
+
 	file.Mux.RLock()
 	defer file.Mux.RUnlock()
 
-	if req.Offset >= int64(len(file.Data)) {
+	if req.Offset >= int64(file.Attributes.Size) {
 		res.Data = []byte{}
 		return nil
 	}
 
-	offset := int(req.Offset)
-	end := offset + req.Size
+	end := uint64(req.Offset) + uint64(req.Size)
+	if end > file.Attributes.Size {
+		end = file.Attributes.Size
+	}
 
-	if end > len(file.Data) {
-		end = len(file.Data)
+	out, err := file.readRangeLocked(uint64(req.Offset), end)
+	if err != nil {
+		return err
 	}
 
-	res.Data = file.Data[offset:end]
+	res.Data = out
 	return nil
 }
 
+// readRangeLocked returns the plaintext of [start, end), dispatching to
+// whichever backing store this file uses. Callers must hold at least
+// file.Mux.RLock().
+func (file *File) readRangeLocked(start, end uint64) ([]byte, error) {
+	bSize := uint64(file.blockSize())
+
+	if file.dedupEnabled() {
+		out := make([]byte, 0, end-start)
+		for pos := start; pos < end; {
+			blockNo := pos / bSize
+			blockOff := pos % bSize
+
+			plaintext, err := file.blockAtLocked(blockNo)
+			if err != nil {
+				return nil, err
+			}
+
+			n := bSize - blockOff
+			if remaining := end - pos; n > remaining {
+				n = remaining
+			}
+
+			out = append(out, plaintext[blockOff:blockOff+n]...)
+			pos += n
+		}
+
+		return out, nil
+	}
+
+	inode := file.Attributes.Inode
+	bs := file.Context.Blocks
+
+	out := make([]byte, 0, end-start)
+	for pos := start; pos < end; {
+		blockNo := pos / bSize
+		blockOff := pos % bSize
+
+		plaintext, err := bs.ReadBlock(inode, blockNo)
+		if err != nil {
+			return nil, err
+		}
+
+		n := bSize - blockOff
+		if remaining := end - pos; n > remaining {
+			n = remaining
+		}
+
+		out = append(out, plaintext[blockOff:blockOff+n]...)
+		pos += n
+	}
+
+	return out, nil
+}
+
 func (file *File) Write(
 	ctx context.Context,
 	req *fuse.WriteRequest,
 	res *fuse.WriteResponse,
-) error {
+) (err error) {
+	finish := trace.Start("File.Write", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", file.Attributes.Inode),
+				fmt.Sprintf("offset=%d len=%d", req.Offset, len(req.Data))
+		})
+	defer func() { finish(err) }()
+
 	file.Mux.Lock()
 	defer file.Mux.Unlock()
 
@@ -169,30 +477,238 @@ func (file *File) Write(
 		return syscall.EFBIG
 	}
 
-	fileLen := uint64(len(file.Data))
-	if newSize > fileLen {
-		newCapacity := newSize
-		if newCapacity < fileLen*2 {
-			newCapacity = fileLen * 2
+	if err := appendJournal(file.Context, journal.OpWrite, journalWritePayload{
+		Inode:  file.Attributes.Inode,
+		Offset: req.Offset,
+		Data:   req.Data,
+	}); err != nil {
+		return err
+	}
+
+	if err := file.writeRangeLocked(uint64(req.Offset), req.Data); err != nil {
+		return err
+	}
+
+	res.Size = int(reqLen)
+	if newSize > file.Attributes.Size {
+		file.Attributes.Size = newSize
+	}
+	file.Attributes.Mtime = time.Now()
+
+	if file.dedupEnabled() {
+		file.trimTailLocked()
+	}
+
+	return nil
+}
+
+// writeRangeLocked patches data into the file starting at offset,
+// dispatching to whichever backing store this file uses. It does not
+// touch file.Attributes.Size; callers are responsible for growing it.
+// Callers must hold file.Mux.
+func (file *File) writeRangeLocked(offset uint64, data []byte) error {
+	bSize := uint64(file.blockSize())
+	reqLen := uint64(len(data))
+
+	if file.dedupEnabled() {
+		for written := uint64(0); written < reqLen; {
+			pos := offset + written
+			blockNo := pos / bSize
+			blockOff := pos % bSize
+
+			n := bSize - blockOff
+			if remaining := reqLen - written; n > remaining {
+				n = remaining
+			}
+
+			plaintext, err := file.blockAtLocked(blockNo)
+			if err != nil {
+				return err
+			}
+
+			copy(plaintext[blockOff:blockOff+n], data[written:written+n])
+
+			// Only the very last block this call touches can become the
+			// new Tail; setBlockLocked ignores this flag for blocks that
+			// already exist as full dedup'd blocks.
+			isFinalBlock := pos+n == offset+reqLen
+			if err := file.setBlockLocked(blockNo, plaintext, isFinalBlock); err != nil {
+				return err
+			}
+
+			written += n
+		}
+
+		return nil
+	}
+
+	inode := file.Attributes.Inode
+	bs := file.Context.Blocks
+
+	for written := uint64(0); written < reqLen; {
+		pos := offset + written
+		blockNo := pos / bSize
+		blockOff := pos % bSize
+
+		n := bSize - blockOff
+		if remaining := reqLen - written; n > remaining {
+			n = remaining
 		}
 
-		if newCapacity > MAX_FILE_SIZE {
-			newCapacity = MAX_FILE_SIZE
+		var plaintext []byte
+		if blockOff == 0 && n == bSize {
+			plaintext = make([]byte, bSize)
+		} else {
+			var err error
+			plaintext, err = bs.ReadBlock(inode, blockNo)
+			if err != nil {
+				return err
+			}
 		}
 
-		newData := make([]byte, newSize, newCapacity)
-		copy(newData, file.Data)
+		copy(plaintext[blockOff:blockOff+n], data[written:written+n])
+		if err := bs.WriteBlock(inode, blockNo, plaintext); err != nil {
+			return err
+		}
 
-		file.Data = newData
-	} else if req.Offset+int64(reqLen) > int64(len(file.Data)) {
-		file.Data = file.Data[:req.Offset+int64(reqLen)]
+		written += n
 	}
 
-	copy(file.Data[req.Offset:], req.Data)
-	res.Size = int(reqLen)
+	return nil
+}
 
-	file.Attributes.Size = uint64(len(file.Data))
-	file.Attributes.Mtime = time.Now()
+// trimTailLocked drops the zero padding blockAtLocked/setBlockLocked add
+// to round a partial Tail up to a full block, so what's kept on disk (and
+// hashed into the Merkle tree) matches the file's logical size exactly.
+// Callers must hold file.Mux.
+func (file *File) trimTailLocked() {
+	bSize := uint64(file.blockSize())
+	tailLen := file.Attributes.Size - uint64(len(file.BlockHashes))*bSize
+
+	if tailLen == 0 {
+		file.Tail = nil
+	} else if uint64(len(file.Tail)) > tailLen {
+		file.Tail = file.Tail[:tailLen]
+	}
+}
+
+func (file *File) Getxattr(
+	ctx context.Context,
+	req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse,
+) (err error) {
+	finish := trace.Start("File.Getxattr", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", file.Attributes.Inode), req.Name
+		})
+	defer func() { finish(err) }()
+
+	file.Mux.RLock()
+	defer file.Mux.RUnlock()
+
+	value, ok := file.Xattrs[req.Name]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+
+	if req.Size != 0 && uint32(len(value)) > req.Size {
+		return syscall.ERANGE
+	}
+
+	resp.Xattr = value
+	return nil
+}
+
+func (file *File) Listxattr(
+	ctx context.Context,
+	req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse,
+) (err error) {
+	finish := trace.Start("File.Listxattr", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", file.Attributes.Inode), ""
+		})
+	defer func() { finish(err) }()
+
+	file.Mux.RLock()
+	defer file.Mux.RUnlock()
+
+	for name := range file.Xattrs {
+		resp.Append(name)
+	}
+
+	return nil
+}
+
+func (file *File) Setxattr(
+	ctx context.Context,
+	req *fuse.SetxattrRequest,
+) (err error) {
+	finish := trace.Start("File.Setxattr", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", file.Attributes.Inode), req.Name
+		})
+	defer func() { finish(err) }()
+
+	file.Mux.Lock()
+	defer file.Mux.Unlock()
+
+	if !hasWritePermission(req.Header.Uid, req.Header.Gid, file.Attributes) {
+		return syscall.EACCES
+	}
+
+	if err := checkSetxattr(req.Name, req.Xattr, file.Xattrs); err != nil {
+		return err
+	}
+
+	if err := appendJournal(file.Context, journal.OpXattrSet, journalXattrSetPayload{
+		Inode: file.Attributes.Inode,
+		Name:  req.Name,
+		Value: req.Xattr,
+	}); err != nil {
+		return err
+	}
+
+	if file.Xattrs == nil {
+		file.Xattrs = make(map[string][]byte)
+	}
+
+	file.Xattrs[req.Name] = append([]byte(nil), req.Xattr...)
+	file.Attributes.Ctime = time.Now()
+
+	return nil
+}
+
+func (file *File) Removexattr(
+	ctx context.Context,
+	req *fuse.RemovexattrRequest,
+) (err error) {
+	finish := trace.Start("File.Removexattr", req.Header.Uid, req.Header.Gid, req.Header.Pid,
+		func() (string, string) {
+			return fmt.Sprintf("<inode %d>", file.Attributes.Inode), req.Name
+		})
+	defer func() { finish(err) }()
+
+	file.Mux.Lock()
+	defer file.Mux.Unlock()
+
+	if !hasWritePermission(req.Header.Uid, req.Header.Gid, file.Attributes) {
+		return syscall.EACCES
+	}
+
+	if _, ok := file.Xattrs[req.Name]; !ok {
+		return fuse.ErrNoXattr
+	}
+
+	if err := appendJournal(file.Context, journal.OpXattrRemove, journalXattrRemovePayload{
+		Inode: file.Attributes.Inode,
+		Name:  req.Name,
+	}); err != nil {
+		return err
+	}
+
+	delete(file.Xattrs, req.Name)
+	file.Attributes.Ctime = time.Now()
 
 	return nil
 }
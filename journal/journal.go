@@ -0,0 +1,273 @@
+/*
+ * Copyright 2025 Nathanne Isip
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package journal implements a write-ahead log that makes x25fs durable
+// across a crash between two clean unmounts. Every mutating filesystem
+// operation is appended here, encrypted and authenticated, before the
+// in-memory tree is touched; on the next mount the log is replayed on
+// top of the last checkpointed snapshot.
+package journal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// OpType identifies which mutating FUSE call a record came from.
+type OpType uint8
+
+const (
+	OpCreate OpType = iota + 1
+	OpMkdir
+	OpRemove
+	OpRename
+	OpSetattr
+	OpWrite
+	OpSymlink
+	OpLink
+	OpXattrSet
+	OpXattrRemove
+)
+
+const (
+	nonceSize   = 12
+	tagSize     = 16
+	lengthBytes = 4
+)
+
+// Record is one decoded, authenticated journal entry.
+type Record struct {
+	Seq     uint64
+	Op      OpType
+	Payload []byte
+}
+
+// Journal is an append-only, AEAD-sealed log backed by a single sidecar
+// file (conventionally "<disk>.wal").
+type Journal struct {
+	mu   sync.Mutex
+	f    *os.File
+	key  [32]byte
+	seq  uint64
+	path string
+}
+
+// Open opens (creating if necessary) the WAL at path and fast-forwards
+// its sequence counter past the highest seq found in any valid record
+// already there, so a reopen after an unclean shutdown keeps appending
+// monotonically instead of colliding with old seq numbers.
+func Open(path string, key [32]byte) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+
+	j := &Journal{f: f, key: key, path: path}
+
+	var maxSeq uint64
+	if err := Replay(path, key, 0, func(rec Record) error {
+		if rec.Seq > maxSeq {
+			maxSeq = rec.Seq
+		}
+		return nil
+	}); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	j.seq = maxSeq
+	return j, nil
+}
+
+// Append seals payload and writes it to the tail of the log with a fresh
+// monotonic sequence number, returning that sequence number.
+func (j *Journal) Append(op OpType, payload []byte) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.seq++
+	seq := j.seq
+
+	block, err := aes.NewCipher(j.key[:])
+	if err != nil {
+		return 0, fmt.Errorf("new cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return 0, fmt.Errorf("new gcm: %w", err)
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, fmt.Errorf("generate nonce: %w", err)
+	}
+
+	ciphertext := gcm.Seal(nil, nonce, payload, recordAAD(seq, op))
+
+	frame := make([]byte, 0, 8+1+nonceSize+len(ciphertext))
+	frame = binary.BigEndian.AppendUint64(frame, seq)
+	frame = append(frame, byte(op))
+	frame = append(frame, nonce...)
+	frame = append(frame, ciphertext...)
+
+	header := make([]byte, lengthBytes)
+	binary.BigEndian.PutUint32(header, uint32(len(frame)))
+
+	if _, err := j.f.Write(append(header, frame...)); err != nil {
+		return 0, fmt.Errorf("append record: %w", err)
+	}
+
+	return seq, nil
+}
+
+// Seq returns the sequence number of the most recently appended record.
+func (j *Journal) Seq() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.seq
+}
+
+// Sync flushes the WAL to stable storage.
+func (j *Journal) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.f.Sync()
+}
+
+// Size reports the current on-disk size of the WAL, used to decide when
+// a checkpoint is due.
+func (j *Journal) Size() (int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	fi, err := j.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+// Checkpoint truncates the WAL once its contents are known to be durably
+// reflected in a fresh base snapshot. The sequence counter is left
+// untouched so records written after the checkpoint keep unique,
+// monotonically increasing sequence numbers.
+func (j *Journal) Checkpoint() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.f.Truncate(0); err != nil {
+		return fmt.Errorf("truncate journal: %w", err)
+	}
+
+	if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek journal: %w", err)
+	}
+
+	return nil
+}
+
+// ReplayFrom replays this journal's own WAL file, applying fn to every
+// record with Seq > afterSeq. See Replay for the crash-tail semantics.
+func (j *Journal) ReplayFrom(afterSeq uint64, fn func(Record) error) error {
+	return Replay(j.path, j.key, afterSeq, fn)
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.f.Close()
+}
+
+// Replay reads every record in the WAL at path, in order, calling fn for
+// each one with rec.Seq > afterSeq. It stops at the first record that
+// fails to decode or authenticate rather than returning an error,
+// because that's exactly the shape a crash mid-write leaves behind: a
+// truncated or partially-flushed tail that must be discarded, not
+// treated as corruption of the whole log.
+func Replay(path string, key [32]byte, afterSeq uint64, fn func(Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("open journal: %w", err)
+	}
+	defer f.Close()
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return fmt.Errorf("new cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("new gcm: %w", err)
+	}
+
+	header := make([]byte, lengthBytes)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			return nil
+		}
+
+		frameLen := binary.BigEndian.Uint32(header)
+		if frameLen < 8+1+nonceSize+tagSize {
+			return nil
+		}
+
+		frame := make([]byte, frameLen)
+		if _, err := io.ReadFull(f, frame); err != nil {
+			return nil
+		}
+
+		seq := binary.BigEndian.Uint64(frame[:8])
+		op := OpType(frame[8])
+		nonce := frame[9 : 9+nonceSize]
+		ciphertext := frame[9+nonceSize:]
+
+		plaintext, err := gcm.Open(nil, nonce, ciphertext, recordAAD(seq, op))
+		if err != nil {
+			return nil
+		}
+
+		if seq <= afterSeq {
+			continue
+		}
+
+		if err := fn(Record{Seq: seq, Op: op, Payload: plaintext}); err != nil {
+			return err
+		}
+	}
+}
+
+func recordAAD(seq uint64, op OpType) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad[:8], seq)
+	aad[8] = byte(op)
+	return aad
+}
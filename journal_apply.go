@@ -0,0 +1,396 @@
+/*
+ * Copyright 2025 Nathanne Isip
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/nthnn/x25fs/journal"
+	"github.com/shamaton/msgpack/v2"
+)
+
+// journalCreatePayload and friends are the on-disk shape of a mutating
+// op recorded to the WAL. They're addressed by inode rather than path so
+// replay stays correct even if something upstream of them was renamed by
+// a later record in the same log.
+type journalCreatePayload struct {
+	ParentInode uint64      `msgpack:"parent_inode"`
+	Name        string      `msgpack:"name"`
+	Inode       uint64      `msgpack:"inode"`
+	Mode        os.FileMode `msgpack:"mode"`
+	Uid         uint32      `msgpack:"uid"`
+	Gid         uint32      `msgpack:"gid"`
+	CreatedAt   time.Time   `msgpack:"created_at"`
+}
+
+type journalMkdirPayload struct {
+	ParentInode uint64      `msgpack:"parent_inode"`
+	Name        string      `msgpack:"name"`
+	Inode       uint64      `msgpack:"inode"`
+	Mode        os.FileMode `msgpack:"mode"`
+	Uid         uint32      `msgpack:"uid"`
+	Gid         uint32      `msgpack:"gid"`
+	CreatedAt   time.Time   `msgpack:"created_at"`
+}
+
+type journalRemovePayload struct {
+	ParentInode uint64 `msgpack:"parent_inode"`
+	Name        string `msgpack:"name"`
+}
+
+type journalRenamePayload struct {
+	OldParentInode uint64 `msgpack:"old_parent_inode"`
+	NewParentInode uint64 `msgpack:"new_parent_inode"`
+	OldName        string `msgpack:"old_name"`
+	NewName        string `msgpack:"new_name"`
+}
+
+type journalSetattrPayload struct {
+	Inode      uint64      `msgpack:"inode"`
+	ValidMode  bool        `msgpack:"valid_mode"`
+	ValidUid   bool        `msgpack:"valid_uid"`
+	ValidGid   bool        `msgpack:"valid_gid"`
+	ValidAtime bool        `msgpack:"valid_atime"`
+	ValidMtime bool        `msgpack:"valid_mtime"`
+	ValidSize  bool        `msgpack:"valid_size"`
+	Mode       os.FileMode `msgpack:"mode"`
+	Uid        uint32      `msgpack:"uid"`
+	Gid        uint32      `msgpack:"gid"`
+	Atime      time.Time   `msgpack:"atime"`
+	Mtime      time.Time   `msgpack:"mtime"`
+	Size       uint64      `msgpack:"size"`
+}
+
+type journalWritePayload struct {
+	Inode  uint64 `msgpack:"inode"`
+	Offset int64  `msgpack:"offset"`
+	Data   []byte `msgpack:"data"`
+}
+
+type journalSymlinkPayload struct {
+	ParentInode uint64 `msgpack:"parent_inode"`
+	Name        string `msgpack:"name"`
+	Inode       uint64 `msgpack:"inode"`
+	Target      string `msgpack:"target"`
+	Uid         uint32 `msgpack:"uid"`
+	Gid         uint32 `msgpack:"gid"`
+}
+
+type journalLinkPayload struct {
+	ParentInode uint64 `msgpack:"parent_inode"`
+	Name        string `msgpack:"name"`
+	Inode       uint64 `msgpack:"inode"`
+}
+
+type journalXattrSetPayload struct {
+	Inode uint64 `msgpack:"inode"`
+	Name  string `msgpack:"name"`
+	Value []byte `msgpack:"value"`
+}
+
+type journalXattrRemovePayload struct {
+	Inode uint64 `msgpack:"inode"`
+	Name  string `msgpack:"name"`
+}
+
+// appendJournal is a no-op when journaling is disabled, so call sites in
+// Dir/File don't need to branch on ctx being journal-less themselves.
+func appendJournal(ctx *FSContext, op journal.OpType, payload any) error {
+	if ctx == nil || ctx.Journal == nil {
+		return nil
+	}
+
+	buf, err := msgpack.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encode journal payload: %w", err)
+	}
+
+	_, err = ctx.Journal.Append(op, buf)
+	return err
+}
+
+// findByInode walks the tree looking for the node with the given inode.
+// It's only used during journal replay (once per mount, at most once per
+// logged record), where simplicity matters more than lookup speed.
+func findByInode(root *Dir, inode uint64) fs.Node {
+	if root.Attributes.Inode == inode {
+		return root
+	}
+
+	for _, child := range root.Children {
+		switch n := child.(type) {
+		case *Dir:
+			if found := findByInode(n, inode); found != nil {
+				return found
+			}
+		case *File:
+			if n.Attributes.Inode == inode {
+				return n
+			}
+		case *Symlink:
+			if n.Attributes.Inode == inode {
+				return n
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReplayJournal applies every WAL record with Seq > afterSeq on top of
+// root, reproducing the mutations a crash prevented from reaching the
+// base snapshot. It bypasses the permission checks the original FUSE
+// handlers ran, since a record only exists because those checks already
+// passed once.
+func ReplayJournal(root *Dir, ctx *FSContext, afterSeq uint64) error {
+	if ctx.Journal == nil {
+		return nil
+	}
+
+	return ctx.Journal.ReplayFrom(afterSeq, func(rec journal.Record) error {
+		switch rec.Op {
+		case journal.OpCreate:
+			var p journalCreatePayload
+			if err := msgpack.Unmarshal(rec.Payload, &p); err != nil {
+				return err
+			}
+
+			parent, ok := findByInode(root, p.ParentInode).(*Dir)
+			if !ok {
+				return nil
+			}
+
+			parent.Children[p.Name] = &File{
+				Attributes: fuse.Attr{
+					Inode: p.Inode,
+					Mode:  p.Mode,
+					Uid:   p.Uid,
+					Gid:   p.Gid,
+					Atime: p.CreatedAt,
+					Mtime: p.CreatedAt,
+					Ctime: p.CreatedAt,
+					Nlink: 1,
+				},
+				Context: ctx,
+			}
+
+		case journal.OpMkdir:
+			var p journalMkdirPayload
+			if err := msgpack.Unmarshal(rec.Payload, &p); err != nil {
+				return err
+			}
+
+			parent, ok := findByInode(root, p.ParentInode).(*Dir)
+			if !ok {
+				return nil
+			}
+
+			parent.Children[p.Name] = &Dir{
+				Attributes: fuse.Attr{
+					Inode: p.Inode,
+					Mode:  p.Mode,
+					Uid:   p.Uid,
+					Gid:   p.Gid,
+					Atime: p.CreatedAt,
+					Mtime: p.CreatedAt,
+					Ctime: p.CreatedAt,
+				},
+				Children: make(map[string]fs.Node),
+				Context:  ctx,
+			}
+
+		case journal.OpRemove:
+			var p journalRemovePayload
+			if err := msgpack.Unmarshal(rec.Payload, &p); err != nil {
+				return err
+			}
+
+			if parent, ok := findByInode(root, p.ParentInode).(*Dir); ok {
+				delete(parent.Children, p.Name)
+			}
+
+		case journal.OpRename:
+			var p journalRenamePayload
+			if err := msgpack.Unmarshal(rec.Payload, &p); err != nil {
+				return err
+			}
+
+			oldParent, ok1 := findByInode(root, p.OldParentInode).(*Dir)
+			newParent, ok2 := findByInode(root, p.NewParentInode).(*Dir)
+			if !ok1 || !ok2 {
+				return nil
+			}
+
+			if child, exists := oldParent.Children[p.OldName]; exists {
+				delete(oldParent.Children, p.OldName)
+				newParent.Children[p.NewName] = child
+			}
+
+		case journal.OpSymlink:
+			var p journalSymlinkPayload
+			if err := msgpack.Unmarshal(rec.Payload, &p); err != nil {
+				return err
+			}
+
+			parent, ok := findByInode(root, p.ParentInode).(*Dir)
+			if !ok {
+				return nil
+			}
+
+			parent.Children[p.Name] = &Symlink{
+				Attributes: fuse.Attr{
+					Inode: p.Inode,
+					Mode:  os.ModeSymlink | 0777,
+					Size:  uint64(len(p.Target)),
+					Nlink: 1,
+					Uid:   p.Uid,
+					Gid:   p.Gid,
+				},
+				Target: p.Target,
+			}
+
+		case journal.OpLink:
+			var p journalLinkPayload
+			if err := msgpack.Unmarshal(rec.Payload, &p); err != nil {
+				return err
+			}
+
+			parent, ok := findByInode(root, p.ParentInode).(*Dir)
+			file, ok2 := findByInode(root, p.Inode).(*File)
+			if !ok || !ok2 {
+				return nil
+			}
+
+			file.Attributes.Nlink++
+			parent.Children[p.Name] = file
+
+		case journal.OpSetattr:
+			var p journalSetattrPayload
+			if err := msgpack.Unmarshal(rec.Payload, &p); err != nil {
+				return err
+			}
+
+			applySetattr(findByInode(root, p.Inode), p)
+
+		case journal.OpWrite:
+			var p journalWritePayload
+			if err := msgpack.Unmarshal(rec.Payload, &p); err != nil {
+				return err
+			}
+
+			if file, ok := findByInode(root, p.Inode).(*File); ok {
+				if err := applyWrite(file, p); err != nil {
+					return err
+				}
+			}
+
+		case journal.OpXattrSet:
+			var p journalXattrSetPayload
+			if err := msgpack.Unmarshal(rec.Payload, &p); err != nil {
+				return err
+			}
+
+			setXattrLocked(findByInode(root, p.Inode), p.Name, p.Value)
+
+		case journal.OpXattrRemove:
+			var p journalXattrRemovePayload
+			if err := msgpack.Unmarshal(rec.Payload, &p); err != nil {
+				return err
+			}
+
+			removeXattrLocked(findByInode(root, p.Inode), p.Name)
+		}
+
+		return nil
+	})
+}
+
+func setXattrLocked(node fs.Node, name string, value []byte) {
+	switch n := node.(type) {
+	case *Dir:
+		if n.Xattrs == nil {
+			n.Xattrs = make(map[string][]byte)
+		}
+		n.Xattrs[name] = value
+	case *File:
+		if n.Xattrs == nil {
+			n.Xattrs = make(map[string][]byte)
+		}
+		n.Xattrs[name] = value
+	}
+}
+
+func removeXattrLocked(node fs.Node, name string) {
+	switch n := node.(type) {
+	case *Dir:
+		delete(n.Xattrs, name)
+	case *File:
+		delete(n.Xattrs, name)
+	}
+}
+
+func applySetattr(node fs.Node, p journalSetattrPayload) {
+	var attr *fuse.Attr
+	switch n := node.(type) {
+	case *Dir:
+		attr = &n.Attributes
+	case *File:
+		attr = &n.Attributes
+	default:
+		return
+	}
+
+	if p.ValidMode {
+		attr.Mode = p.Mode
+	}
+	if p.ValidUid {
+		attr.Uid = p.Uid
+	}
+	if p.ValidGid {
+		attr.Gid = p.Gid
+	}
+	if p.ValidAtime {
+		attr.Atime = p.Atime
+	}
+	if p.ValidMtime {
+		attr.Mtime = p.Mtime
+	}
+	if p.ValidSize {
+		attr.Size = p.Size
+	}
+}
+
+func applyWrite(file *File, p journalWritePayload) error {
+	if err := file.writeRangeLocked(uint64(p.Offset), p.Data); err != nil {
+		return err
+	}
+
+	if newSize := uint64(p.Offset) + uint64(len(p.Data)); newSize > file.Attributes.Size {
+		file.Attributes.Size = newSize
+	}
+
+	if file.dedupEnabled() {
+		file.trimTailLocked()
+	}
+
+	return nil
+}
@@ -32,9 +32,61 @@ import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 
+	"github.com/nthnn/x25fs/trace"
 	"github.com/nthnn/xbin25"
 )
 
+const (
+	defaultCheckpointInterval = 5 * time.Minute
+	defaultWALMaxBytes        = 64 * 1024 * 1024
+	journalFsyncInterval      = 2 * time.Second
+)
+
+// runJournalMaintenance keeps the WAL durable and bounded in size while
+// the filesystem is mounted: it fsyncs on a short, fixed cadence and
+// checkpoints (rewriting the base snapshot and truncating the WAL) on
+// checkpointInterval or as soon as the WAL passes walMaxBytes, whichever
+// comes first.
+func runJournalMaintenance(
+	xfs *X25fs,
+	cfg *xbin25.XBin25Config,
+	diskPath string,
+	checkpointInterval time.Duration,
+	walMaxBytes int64,
+	stop <-chan struct{},
+) {
+	fsyncTicker := time.NewTicker(journalFsyncInterval)
+	defer fsyncTicker.Stop()
+
+	checkpointTicker := time.NewTicker(checkpointInterval)
+	defer checkpointTicker.Stop()
+
+	j := xfs.RootDir.Context.Journal
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-fsyncTicker.C:
+			if err := j.Sync(); err != nil {
+				log.Println("Journal sync failed:", err)
+				continue
+			}
+
+			if size, err := j.Size(); err == nil && size >= walMaxBytes {
+				if err := Checkpoint(xfs, cfg, diskPath); err != nil {
+					log.Println("Journal checkpoint failed:", err)
+				}
+			}
+
+		case <-checkpointTicker.C:
+			if err := Checkpoint(xfs, cfg, diskPath); err != nil {
+				log.Println("Journal checkpoint failed:", err)
+			}
+		}
+	}
+}
+
 func CheckMountpointSecurity(mountpoint string) error {
 	absPath, err := filepath.Abs(mountpoint)
 	if err != nil {
@@ -78,6 +130,13 @@ func main() {
 	dur := flag.Duration("duration", 36*time.Hour, "max age for replay protection")
 	blockSize := flag.Int("block-size", 1024*1024, "compression block size")
 	diskFile := flag.String("disk", "data.x25disk", "Path to the disk image file")
+	fileBlockSize := flag.Int("file-block-size", DEFAULT_FILE_BLOCK_SIZE, "plaintext block size used for per-file AEAD-sealed content")
+	journalMode := flag.String("journal", "on", "write-ahead journal mode: on|off")
+	checkpointInterval := flag.Duration("checkpoint-interval", defaultCheckpointInterval, "how often to checkpoint the base snapshot and truncate the journal")
+	walMaxBytes := flag.Int64("wal-max-bytes", defaultWALMaxBytes, "journal size, in bytes, past which a checkpoint is forced early")
+	dedup := flag.Bool("dedup", false, "store file content in a content-addressed block store shared across files, instead of one block file per inode")
+	traceSink := flag.String("trace", "", "record every FUSE op to an audit sink: stderr|jsonl:/path|unix:/path (empty disables tracing)")
+	traceSample := flag.Float64("trace-sample", 1.0, "fraction of FUSE ops to record when -trace is set, e.g. 0.01 for 1%")
 
 	flag.Parse()
 	if flag.NArg() != 1 {
@@ -85,11 +144,31 @@ func main() {
 		os.Exit(1)
 	}
 
+	var journalEnabled bool
+	switch *journalMode {
+	case "on":
+		journalEnabled = true
+	case "off":
+		journalEnabled = false
+	default:
+		log.Fatalf("invalid -journal value %q: want \"on\" or \"off\"", *journalMode)
+	}
+
 	mountpoint := flag.Arg(0)
 	if err := CheckMountpointSecurity(mountpoint); err != nil {
 		log.Fatal("Mountpoint security check failed:", err)
 	}
 
+	if *traceSink != "" {
+		sink, err := trace.NewSink(*traceSink)
+		if err != nil {
+			log.Fatal("Create trace sink: ", err)
+		}
+
+		trace.SetGlobal(trace.New(sink, *traceSample))
+		defer trace.Close()
+	}
+
 	diskPath, err := filepath.Abs(*diskFile)
 	if err != nil {
 		log.Fatal("Failed to get absolute path: ", err)
@@ -110,7 +189,7 @@ func main() {
 
 	var xfs *X25fs
 	if _, err := os.Stat(diskPath); err == nil {
-		xfs, err = LoadData(cfg, diskPath)
+		xfs, err = LoadData(cfg, diskPath, journalEnabled)
 		if err != nil {
 			log.Fatal("Read disk: ", err)
 		}
@@ -127,6 +206,26 @@ func main() {
 			}
 		}
 
+		blocks, err := NewBlockStore(blocksDirFor(diskPath), *fileBlockSize)
+		if err != nil {
+			log.Fatal("Create block store: ", err)
+		}
+
+		fsCtx := &FSContext{Config: cfg, Blocks: blocks}
+		if *dedup {
+			dedupStore, err := NewDedupStore(dedupDirFor(diskPath), *fileBlockSize, blocks.MasterKey())
+			if err != nil {
+				log.Fatal("Create dedup store: ", err)
+			}
+			fsCtx.Dedup = dedupStore
+		}
+
+		if journalEnabled {
+			if err := attachJournal(fsCtx, diskPath); err != nil {
+				log.Fatal("Create journal: ", err)
+			}
+		}
+
 		xfs = &X25fs{
 			RootDir: &Dir{
 				Attributes: fuse.Attr{
@@ -136,7 +235,7 @@ func main() {
 					Gid:   uint32(gid),
 				},
 				Children: make(map[string]fs.Node),
-				Config:   cfg,
+				Context:  fsCtx,
 			},
 		}
 	}
@@ -162,6 +261,21 @@ func main() {
 		}
 	}()
 
+	stopMaintenance := make(chan struct{})
+	if xfs.RootDir.Context.Journal != nil {
+		go runJournalMaintenance(xfs, cfg, diskPath, *checkpointInterval, *walMaxBytes, stopMaintenance)
+	}
+
+	// KNOWN GAP (nthnn/x25fs#chunk0-6): SEEK_HOLE/SEEK_DATA and
+	// copy_file_range(2) are not reachable through this mount. The
+	// pinned bazil.org/fuse predates the FUSE_LSEEK and
+	// FUSE_COPY_FILE_RANGE kernel opcodes, so there's no
+	// fs.HandleLseeker/fs.NodeCopyFileRanger to implement; lseek(fd, off,
+	// SEEK_HOLE) and copy_file_range(2) against files on this mount fall
+	// back to the kernel's generic (non-sparse-aware) emulation. See
+	// sparse.go for the in-process SeekHoleData/CopyRange this blocks.
+	log.Println("Note: SEEK_HOLE/SEEK_DATA and copy_file_range(2) are not exposed through this FUSE mount (see sparse.go)")
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
@@ -195,6 +309,8 @@ func main() {
 		}
 	}
 
+	close(stopMaintenance)
+
 	saveErr := SaveData(xfs, cfg, diskPath)
 	log.Println("Saving filesystem state...")
 
@@ -38,19 +38,29 @@ func CurrentInodeCounter() uint64 {
 	return atomic.LoadUint64(&inodeCounter)
 }
 
+// GetTotalInodes counts distinct inodes reachable from dir. Hardlinked
+// files share one inode across multiple directory entries, so entries
+// are deduplicated rather than counted per-entry.
 func GetTotalInodes(dir *Dir) uint64 {
+	seen := make(map[uint64]struct{})
+	collectInodes(dir, seen)
+
+	return uint64(len(seen))
+}
+
+func collectInodes(dir *Dir, seen map[uint64]struct{}) {
 	dir.Mux.RLock()
 	defer dir.Mux.RUnlock()
 
-	count := uint64(1)
+	seen[dir.Attributes.Inode] = struct{}{}
 	for _, node := range dir.Children {
 		switch n := node.(type) {
 		case *Dir:
-			count += GetTotalInodes(n)
+			collectInodes(n, seen)
 		case *File:
-			count++
+			seen[n.Attributes.Inode] = struct{}{}
+		case *Symlink:
+			seen[n.Attributes.Inode] = struct{}{}
 		}
 	}
-
-	return count
 }
@@ -18,51 +18,113 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"github.com/google/renameio"
+	"github.com/nthnn/x25fs/journal"
 	"github.com/nthnn/xbin25"
 
 	"github.com/shamaton/msgpack/v2"
 )
 
 type SerializableX25fs struct {
-	Version      uint32           `msgpack:"version"`
-	RootDir      *SerializableDir `msgpack:"root"`
-	InodeCounter uint64           `msgpack:"inode_counter"`
+	Version       uint32           `msgpack:"version"`
+	RootDir       *SerializableDir `msgpack:"root"`
+	InodeCounter  uint64           `msgpack:"inode_counter"`
+	MasterKey     []byte           `msgpack:"master_key"`
+	BlockSize     int              `msgpack:"block_size"`
+	CheckpointSeq uint64           `msgpack:"checkpoint_seq"`
+	DedupEnabled  bool             `msgpack:"dedup_enabled"`
+
+	// RootHash is the Merkle root over the whole tree (see
+	// computeTreeHash): a reader can use it to confirm nothing in the
+	// snapshot was tampered with outside the usual AEAD-sealed layers.
+	RootHash []byte `msgpack:"root_hash"`
 }
 
 type SerializableNode struct {
 	Type string            `msgpack:"type"`
 	Dir  *SerializableDir  `msgpack:"directory,omitempty"`
 	File *SerializableFile `msgpack:"file,omitempty"`
+
+	Symlink *SerializableSymlink `msgpack:"symlink,omitempty"`
+
+	// HardlinkInode is only set when Type == "hardlink": it names the
+	// inode of a *File that was already emitted in full elsewhere in the
+	// tree, so DeserializeDir can point this entry at that same object
+	// instead of constructing a second one.
+	HardlinkInode uint64 `msgpack:"hardlink_inode,omitempty"`
+}
+
+type SerializableSymlink struct {
+	Attributes fuse.Attr `msgpack:"attr"`
+	Target     string    `msgpack:"target"`
 }
 
 type SerializableDir struct {
 	Attributes fuse.Attr                   `msgpack:"attr"`
 	Children   map[string]SerializableNode `msgpack:"children"`
+	Xattrs     map[string][]byte           `msgpack:"xattrs,omitempty"`
 }
 
+// SerializableFile only carries metadata: in the default mode, content
+// lives in the BlockStore's own file-per-inode layout on disk, keyed by
+// inode number, so it never has to round-trip through this msgpack blob.
+// In -dedup mode, content instead lives in the shared DedupStore, so this
+// carries the block hash references (and the private trailing-block
+// buffer) needed to find it there.
 type SerializableFile struct {
-	Attributes fuse.Attr `msgpack:"attr"`
-	Data       []byte    `msgpack:"data"`
+	Attributes  fuse.Attr         `msgpack:"attr"`
+	Xattrs      map[string][]byte `msgpack:"xattrs,omitempty"`
+	BlockHashes [][32]byte        `msgpack:"block_hashes,omitempty"`
+	Tail        []byte            `msgpack:"tail,omitempty"`
 }
 
-const X25FS_VERSION = 10000
+const X25FS_VERSION = 10002
 
-func SaveData(xfs *X25fs, cfg *xbin25.XBin25Config, diskFile string) error {
+// blocksDirFor derives the block store directory from the disk image
+// path, e.g. "data.x25disk" -> "data.x25disk.blocks".
+func blocksDirFor(diskFile string) string {
+	return diskFile + ".blocks"
+}
+
+// dedupDirFor derives the content-addressable store directory from the
+// disk image path, e.g. "data.x25disk" -> "data.x25disk.cas".
+func dedupDirFor(diskFile string) string {
+	return diskFile + ".cas"
+}
+
+// Checkpoint writes a fresh base snapshot without tearing anything down,
+// and - if a journal is attached - truncates the WAL now that its
+// contents are durably reflected in that snapshot. It's safe to call
+// repeatedly while the filesystem is mounted and serving requests.
+func Checkpoint(xfs *X25fs, cfg *xbin25.XBin25Config, diskFile string) error {
 	xfs.RootDir.Mux.RLock()
 	defer xfs.RootDir.Mux.RUnlock()
 
+	ctx := xfs.RootDir.Context
 	sxfs := &SerializableX25fs{
 		RootDir:      SerializeDir(xfs.RootDir),
 		InodeCounter: CurrentInodeCounter(),
 		Version:      X25FS_VERSION,
+		BlockSize:    ctx.Blocks.BlockSize(),
+		DedupEnabled: ctx.Dedup != nil,
+	}
+
+	masterKey := ctx.Blocks.MasterKey()
+	sxfs.MasterKey = masterKey[:]
+
+	if ctx.Journal != nil {
+		sxfs.CheckpointSeq = ctx.Journal.Seq()
 	}
 
+	rootHash := computeTreeHash(xfs.RootDir)
+	sxfs.RootHash = rootHash[:]
+
 	buf, err := msgpack.Marshal(sxfs)
 	if err != nil {
 		return fmt.Errorf("msgpack encode failed: %w", err)
@@ -77,10 +139,38 @@ func SaveData(xfs *X25fs, cfg *xbin25.XBin25Config, diskFile string) error {
 		return fmt.Errorf("atomic write failed: %w", err)
 	}
 
+	if ctx.Journal != nil {
+		if err := ctx.Blocks.Sync(); err != nil {
+			return fmt.Errorf("sync block store: %w", err)
+		}
+
+		if err := ctx.Journal.Checkpoint(); err != nil {
+			return fmt.Errorf("truncate journal: %w", err)
+		}
+	}
+
 	return nil
 }
 
-func LoadData(cfg *xbin25.XBin25Config, diskFile string) (*X25fs, error) {
+func SaveData(xfs *X25fs, cfg *xbin25.XBin25Config, diskFile string) error {
+	if err := Checkpoint(xfs, cfg, diskFile); err != nil {
+		return err
+	}
+
+	ctx := xfs.RootDir.Context
+	if ctx.Journal != nil {
+		if err := ctx.Journal.Close(); err != nil {
+			return fmt.Errorf("close journal: %w", err)
+		}
+	}
+
+	return ctx.Blocks.Close()
+}
+
+// LoadData reconstructs the tree from the last checkpoint and, when
+// journalEnabled is true, replays any WAL records written after that
+// checkpoint before handing the tree back to the caller.
+func LoadData(cfg *xbin25.XBin25Config, diskFile string, journalEnabled bool) (*X25fs, error) {
 	encrypted, err := os.ReadFile(diskFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %w", err)
@@ -110,20 +200,111 @@ func LoadData(cfg *xbin25.XBin25Config, diskFile string) (*X25fs, error) {
 		)
 	}
 
+	var masterKey [32]byte
+	if len(sxfs.MasterKey) != len(masterKey) {
+		return nil, fmt.Errorf("invalid master key length: %d", len(sxfs.MasterKey))
+	}
+	copy(masterKey[:], sxfs.MasterKey)
+
+	blocks, err := OpenBlockStore(blocksDirFor(diskFile), sxfs.BlockSize, masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("open block store: %w", err)
+	}
+
+	fsCtx := &FSContext{Config: cfg, Blocks: blocks}
+	if sxfs.DedupEnabled {
+		dedup, err := NewDedupStore(dedupDirFor(diskFile), sxfs.BlockSize, masterKey)
+		if err != nil {
+			return nil, fmt.Errorf("open dedup store: %w", err)
+		}
+		fsCtx.Dedup = dedup
+	}
+
+	if journalEnabled {
+		if err := attachJournal(fsCtx, diskFile); err != nil {
+			return nil, err
+		}
+	}
+
 	LoadInodeCounter(sxfs.InodeCounter)
 	xfs := &X25fs{
-		RootDir: DeserializeDir(sxfs.RootDir, cfg),
+		RootDir: DeserializeDir(sxfs.RootDir, fsCtx),
 	}
+
+	if fsCtx.Dedup != nil {
+		RebuildRefs(xfs.RootDir)
+	}
+
+	// The stored RootHash authenticates the tree as of the last
+	// checkpoint, but block content is mutated in place on disk as it's
+	// written, so a crash between a checkpoint and the writes a WAL tail
+	// is about to replay leaves the live block store already reading
+	// ahead of that frozen hash. Checking against it here would refuse
+	// to mount on exactly the case the journal exists to recover from,
+	// so the check only applies when there's no tail left to replay.
+	walTailSize := int64(0)
+	if fsCtx.Journal != nil {
+		if walTailSize, err = fsCtx.Journal.Size(); err != nil {
+			return nil, fmt.Errorf("stat journal: %w", err)
+		}
+	}
+
+	if len(sxfs.RootHash) > 0 && walTailSize == 0 {
+		rootHash := computeTreeHash(xfs.RootDir)
+		if !bytes.Equal(rootHash[:], sxfs.RootHash) {
+			return nil, fmt.Errorf("merkle root hash mismatch: tree does not match the authenticated snapshot")
+		}
+	}
+
+	if fsCtx.Journal != nil {
+		if err := ReplayJournal(xfs.RootDir, fsCtx, sxfs.CheckpointSeq); err != nil {
+			return nil, fmt.Errorf("replay journal: %w", err)
+		}
+	}
+
 	return xfs, nil
 }
 
+// walPathFor derives the WAL's sidecar path from the disk image path,
+// e.g. "data.x25disk" -> "data.x25disk.wal".
+func walPathFor(diskFile string) string {
+	return diskFile + ".wal"
+}
+
+// attachJournal opens (or creates) the WAL for ctx's block store and
+// wires it into ctx.Journal, deriving the WAL key from the same master
+// key that protects file content.
+func attachJournal(ctx *FSContext, diskFile string) error {
+	walKey, err := WALKey(ctx.Blocks.MasterKey())
+	if err != nil {
+		return err
+	}
+
+	j, err := journal.Open(walPathFor(diskFile), walKey)
+	if err != nil {
+		return fmt.Errorf("open journal: %w", err)
+	}
+
+	ctx.Journal = j
+	return nil
+}
+
+// SerializeDir walks directory into its wire form. Files are keyed by
+// inode as they're first encountered so a later directory entry pointing
+// at the same *File (a hardlink) is emitted as a lightweight reference
+// instead of a second full copy.
 func SerializeDir(directory *Dir) *SerializableDir {
+	return serializeDir(directory, make(map[uint64]bool))
+}
+
+func serializeDir(directory *Dir, seenInodes map[uint64]bool) *SerializableDir {
 	directory.Mux.RLock()
 	defer directory.Mux.RUnlock()
 
 	sd := &SerializableDir{
 		Attributes: directory.Attributes,
 		Children:   make(map[string]SerializableNode),
+		Xattrs:     directory.Xattrs,
 	}
 
 	for name, node := range directory.Children {
@@ -131,14 +312,35 @@ func SerializeDir(directory *Dir) *SerializableDir {
 		case *Dir:
 			sd.Children[name] = SerializableNode{
 				Type: "dir",
-				Dir:  SerializeDir(n),
+				Dir:  serializeDir(n, seenInodes),
 			}
+
 		case *File:
+			if seenInodes[n.Attributes.Inode] {
+				sd.Children[name] = SerializableNode{
+					Type:          "hardlink",
+					HardlinkInode: n.Attributes.Inode,
+				}
+				continue
+			}
+
+			seenInodes[n.Attributes.Inode] = true
 			sd.Children[name] = SerializableNode{
 				Type: "file",
 				File: &SerializableFile{
+					Attributes:  n.Attributes,
+					Xattrs:      n.Xattrs,
+					BlockHashes: n.BlockHashes,
+					Tail:        n.Tail,
+				},
+			}
+
+		case *Symlink:
+			sd.Children[name] = SerializableNode{
+				Type: "symlink",
+				Symlink: &SerializableSymlink{
 					Attributes: n.Attributes,
-					Data:       n.Data,
+					Target:     n.Target,
 				},
 			}
 		}
@@ -147,24 +349,73 @@ func SerializeDir(directory *Dir) *SerializableDir {
 	return sd
 }
 
-func DeserializeDir(sd *SerializableDir, cfg *xbin25.XBin25Config) *Dir {
+// hardlinkFixup is a directory entry that couldn't be wired up on first
+// pass because its target *File hadn't been deserialized yet.
+type hardlinkFixup struct {
+	parent *Dir
+	name   string
+	inode  uint64
+}
+
+// DeserializeDir rebuilds the tree in two passes: the first constructs
+// every Dir/File/Symlink and records each File by inode, and the second
+// resolves "hardlink" entries against that index so multiple directory
+// entries end up sharing a single *File, regardless of the (unspecified)
+// order the underlying maps were walked in.
+func DeserializeDir(sd *SerializableDir, ctx *FSContext) *Dir {
+	index := make(map[uint64]*File)
+	var pending []hardlinkFixup
+
+	root := deserializeDir(sd, ctx, index, &pending)
+	for _, fixup := range pending {
+		if file, ok := index[fixup.inode]; ok {
+			fixup.parent.Children[fixup.name] = file
+		}
+	}
+
+	return root
+}
+
+func deserializeDir(
+	sd *SerializableDir,
+	ctx *FSContext,
+	index map[uint64]*File,
+	pending *[]hardlinkFixup,
+) *Dir {
 	d := &Dir{
 		Attributes: sd.Attributes,
 		Children:   make(map[string]fs.Node),
-		Config:     cfg,
+		Context:    ctx,
+		Xattrs:     sd.Xattrs,
 	}
 
 	for name, node := range sd.Children {
 		switch node.Type {
 		case "dir":
-			d.Children[name] = DeserializeDir(node.Dir, cfg)
+			d.Children[name] = deserializeDir(node.Dir, ctx, index, pending)
 
 		case "file":
-			d.Children[name] = &File{
-				Attributes: node.File.Attributes,
-				Data:       node.File.Data,
+			file := &File{
+				Attributes:  node.File.Attributes,
+				Context:     ctx,
+				Xattrs:      node.File.Xattrs,
+				BlockHashes: node.File.BlockHashes,
+				Tail:        node.File.Tail,
 			}
+
+			index[file.Attributes.Inode] = file
+			d.Children[name] = file
+
+		case "symlink":
+			d.Children[name] = &Symlink{
+				Attributes: node.Symlink.Attributes,
+				Target:     node.Symlink.Target,
+			}
+
+		case "hardlink":
+			*pending = append(*pending, hardlinkFixup{parent: d, name: name, inode: node.HardlinkInode})
 		}
 	}
+
 	return d
 }
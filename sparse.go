@@ -0,0 +1,218 @@
+/*
+ * Copyright 2025 Nathanne Isip
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/nthnn/x25fs/journal"
+	"golang.org/x/sys/unix"
+)
+
+// Sparse file support rides entirely on the block-based storage
+// introduced for per-file AEAD sealing: growing a file (Setattr with a
+// larger Size, or a Write past the current end) never allocates a
+// make([]byte, newSize) buffer. In the per-inode block store a block a
+// Write never touches is never written and stays a real hole in the
+// block file; in -dedup mode it is either absent from File.BlockHashes
+// (past the last write, or after a Setattr grow) or, when a Write lands
+// past the current end, a reference to the one shared all-zero block,
+// costing one refcount bump per gap block. There's no flat Data []byte
+// left to replace with an extent list - chunk0-1 and chunk0-5 already did that migration.
+//
+// NOT DELIVERED (nthnn/x25fs#chunk0-6): the request asked for this to be
+// reachable from outside the process via fs.HandleLseeker and
+// fs.NodeCopyFileRanger, so SEEK_HOLE/SEEK_DATA and copy_file_range(2)
+// work through the mount. That part is NOT done and cannot be done
+// against the dependency this module is pinned to: bazil.org/fuse, as
+// vendored in go.mod, predates the FUSE_LSEEK and FUSE_COPY_FILE_RANGE
+// kernel opcodes, so fs.HandleLseeker/fs.NodeCopyFileRanger don't exist
+// in that package for *File to implement. A caller going through the
+// kernel gets neither op; see main.go's startup log for the runtime
+// callout. Closing this gap for real requires bumping the FUSE binding
+// (or vendoring the opcode support some other way), which is out of
+// scope for this change.
+//
+// SeekHoleData and CopyRange below are kept as directly-callable
+// in-process methods, not a substitute for the above: the hole/extent
+// accounting they need (hardened by chunk0-1's SEEK_DATA hole check in
+// BlockStore.ReadBlock) is exactly what correct SEEK_HOLE/SEEK_DATA and
+// copy_file_range answers require, so a future FUSE binding that does
+// speak those opcodes gets correct behavior for free. Nothing in this
+// file runs on the hot read/write path today.
+const (
+	SeekData = 3
+	SeekHole = 4
+)
+
+// SeekHoleData implements SEEK_DATA/SEEK_HOLE semantics for this file:
+// given a starting offset, it returns the offset of the next data region
+// (SeekData) or hole (SeekHole) at or after it, per lseek(2).
+func (file *File) SeekHoleData(offset int64, whence int) (int64, error) {
+	file.Mux.RLock()
+	defer file.Mux.RUnlock()
+
+	if whence != SeekData && whence != SeekHole {
+		return 0, syscall.EINVAL
+	}
+
+	size := int64(file.Attributes.Size)
+	if offset < 0 || offset > size {
+		return 0, syscall.ENXIO
+	}
+
+	if offset == size {
+		if whence == SeekHole {
+			return size, nil
+		}
+		return 0, syscall.ENXIO
+	}
+
+	if file.dedupEnabled() {
+		return file.seekHoleDataDedupLocked(offset, whence)
+	}
+
+	result, err := file.Context.Blocks.SeekHoleData(file.Attributes.Inode, offset, whence)
+	if err != nil {
+		if errors.Is(err, unix.ENXIO) && whence == SeekHole {
+			return size, nil
+		}
+		return 0, err
+	}
+
+	// The block store answers in whole blocks; when offset itself lies in
+	// a block of the requested kind, offset is the answer.
+	if result < offset {
+		result = offset
+	}
+	if result > size {
+		result = size
+	}
+	return result, nil
+}
+
+// seekHoleDataDedupLocked answers SeekHoleData from BlockHashes directly:
+// a block is a hole if it's past the end of the list (never written),
+// except for the slot right after it while Tail holds data, or if it's
+// equal to the shared all-zero block (an explicit sparse gap-fill, see
+// File.setBlockLocked). Callers must hold file.Mux.
+func (file *File) seekHoleDataDedupLocked(offset int64, whence int) (int64, error) {
+	bSize := int64(file.blockSize())
+	size := int64(file.Attributes.Size)
+	zeroHash := file.Context.Dedup.ZeroHash()
+
+	for pos := (offset / bSize) * bSize; pos < size; pos += bSize {
+		blockNo := uint64(pos / bSize)
+		var isHole bool
+		if blockNo < uint64(len(file.BlockHashes)) {
+			isHole = file.BlockHashes[blockNo] == zeroHash
+		} else {
+			isHole = blockNo > uint64(len(file.BlockHashes)) || len(file.Tail) == 0
+		}
+
+		start := pos
+		if start < offset {
+			start = offset
+		}
+
+		if whence == SeekHole && isHole {
+			return start, nil
+		}
+		if whence == SeekData && !isHole {
+			return start, nil
+		}
+	}
+
+	if whence == SeekHole {
+		return size, nil
+	}
+	return 0, syscall.ENXIO
+}
+
+// CopyRange copies up to length bytes from src at srcOffset into file at
+// dstOffset, returning the number of bytes actually copied (clamped to
+// src's current size, same as copy_file_range(2)). When both files are
+// in -dedup mode and the copy lands on matching block boundaries, the
+// blocks end up dedup'd against src's existing content automatically
+// (setBlockLocked hashes the copied plaintext and finds it already
+// present), so the copy only costs a refcount bump rather than a second
+// encrypted copy on disk.
+func (file *File) CopyRange(src *File, srcOffset, dstOffset, length int64) (int64, error) {
+	if src == file {
+		file.Mux.Lock()
+		defer file.Mux.Unlock()
+		return file.copyRangeLocked(src, srcOffset, dstOffset, length)
+	}
+
+	// Lock in a fixed order (by inode) regardless of which side is the
+	// copy's destination, so a concurrent copy in the opposite direction
+	// can't deadlock against this one.
+	if file.Attributes.Inode < src.Attributes.Inode {
+		file.Mux.Lock()
+		defer file.Mux.Unlock()
+		src.Mux.RLock()
+		defer src.Mux.RUnlock()
+	} else {
+		src.Mux.RLock()
+		defer src.Mux.RUnlock()
+		file.Mux.Lock()
+		defer file.Mux.Unlock()
+	}
+
+	return file.copyRangeLocked(src, srcOffset, dstOffset, length)
+}
+
+// copyRangeLocked does the actual work. Callers must hold file.Mux
+// (write) and, if src != file, src.Mux (at least read).
+func (file *File) copyRangeLocked(src *File, srcOffset, dstOffset, length int64) (int64, error) {
+	end := srcOffset + length
+	if srcSize := int64(src.Attributes.Size); end > srcSize {
+		end = srcSize
+	}
+	if end <= srcOffset {
+		return 0, nil
+	}
+
+	data, err := src.readRangeLocked(uint64(srcOffset), uint64(end))
+	if err != nil {
+		return 0, err
+	}
+
+	if err := appendJournal(file.Context, journal.OpWrite, journalWritePayload{
+		Inode:  file.Attributes.Inode,
+		Offset: dstOffset,
+		Data:   data,
+	}); err != nil {
+		return 0, err
+	}
+
+	if err := file.writeRangeLocked(uint64(dstOffset), data); err != nil {
+		return 0, err
+	}
+
+	if newSize := uint64(dstOffset) + uint64(len(data)); newSize > file.Attributes.Size {
+		file.Attributes.Size = newSize
+	}
+
+	if file.dedupEnabled() {
+		file.trimTailLocked()
+	}
+
+	return int64(len(data)), nil
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2025 Nathanne Isip
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"bazil.org/fuse"
+)
+
+// Symlink is a fixed target path stored inline on the node; it
+// never touches the block store since its "content" is just the target
+// string the kernel already keeps around after the first readlink.
+type Symlink struct {
+	Mux        sync.RWMutex
+	Attributes fuse.Attr
+	Target     string
+}
+
+func (link *Symlink) Attr(
+	ctx context.Context,
+	attr *fuse.Attr,
+) error {
+	link.Mux.RLock()
+	defer link.Mux.RUnlock()
+
+	*attr = link.Attributes
+	return nil
+}
+
+func (link *Symlink) GetAttr() fuse.Attr {
+	link.Mux.RLock()
+	defer link.Mux.RUnlock()
+
+	return link.Attributes
+}
+
+func (link *Symlink) Readlink(
+	ctx context.Context,
+	req *fuse.ReadlinkRequest,
+) (string, error) {
+	link.Mux.RLock()
+	defer link.Mux.RUnlock()
+
+	return link.Target, nil
+}
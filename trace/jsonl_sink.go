@@ -0,0 +1,127 @@
+/*
+ * Copyright 2025 Nathanne Isip
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// defaultRotateBytes is how large a JSONL trace file is allowed to grow
+// before JSONLSink rotates it out of the way.
+const defaultRotateBytes = 64 * 1024 * 1024
+
+// JSONLSink appends one JSON object per line to a file, rotating it out
+// to a timestamped sibling once it passes maxBytes. Rotation itself is a
+// single os.Rename of the full file followed by renameio.WriteFile
+// recreating an empty one in its place - the same atomic-rename primitive
+// renameio uses for whole-file writes elsewhere in this project - so the
+// rotated file is never half-truncated. Path is absent for the moment
+// between the rename and the recreate.
+type JSONLSink struct {
+	mux      sync.Mutex
+	path     string
+	f        *os.File
+	maxBytes int64
+	written  int64
+}
+
+// NewJSONLSink opens (creating if necessary) path for append, rotating
+// immediately on writes past maxBytes. maxBytes <= 0 disables rotation.
+func NewJSONLSink(path string, maxBytes int64) (*JSONLSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open trace jsonl sink: %w", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stat trace jsonl sink: %w", err)
+	}
+
+	return &JSONLSink{
+		path:     path,
+		f:        f,
+		maxBytes: maxBytes,
+		written:  fi.Size(),
+	}, nil
+}
+
+func (s *JSONLSink) Write(e Entry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal trace entry: %w", err)
+	}
+	buf = append(buf, '\n')
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.maxBytes > 0 && s.written+int64(len(buf)) > s.maxBytes {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.f.Write(buf)
+	s.written += int64(n)
+
+	if err != nil {
+		return fmt.Errorf("write trace entry: %w", err)
+	}
+	return nil
+}
+
+// rotateLocked moves the current file aside and opens a fresh one in its
+// place. Callers must hold s.mux.
+func (s *JSONLSink) rotateLocked() error {
+	if err := s.f.Close(); err != nil {
+		return fmt.Errorf("close trace jsonl sink before rotate: %w", err)
+	}
+
+	rotated := fmt.Sprintf("%s.%d", s.path, time.Now().UnixNano())
+	if err := os.Rename(s.path, rotated); err != nil {
+		return fmt.Errorf("rotate trace jsonl sink: %w", err)
+	}
+
+	if err := renameio.WriteFile(s.path, nil, 0o600); err != nil {
+		return fmt.Errorf("recreate trace jsonl sink after rotate: %w", err)
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("reopen trace jsonl sink after rotate: %w", err)
+	}
+
+	s.f = f
+	s.written = 0
+	return nil
+}
+
+func (s *JSONLSink) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.f.Close()
+}
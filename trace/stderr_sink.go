@@ -0,0 +1,43 @@
+/*
+ * Copyright 2025 Nathanne Isip
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// StderrSink writes one JSON object per line to the process's stderr.
+// It's the cheapest sink to wire up and the default choice for following
+// a mount interactively with -trace=stderr.
+type StderrSink struct{}
+
+func (StderrSink) Write(e Entry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal trace entry: %w", err)
+	}
+
+	_, err = fmt.Fprintln(os.Stderr, string(buf))
+	return err
+}
+
+func (StderrSink) Close() error {
+	return nil
+}
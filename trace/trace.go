@@ -0,0 +1,197 @@
+/*
+ * Copyright 2025 Nathanne Isip
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package trace is an optional, pluggable audit log for FUSE operations:
+// every mutating and read call on *Dir and *File can report
+// {timestamp, op, uid, gid, pid, path, args, duration, error} to a Sink, so
+// a decrypted mount can be observed live instead of staying an opaque blob.
+// It's off by default and, when off, costs callers a single atomic bool
+// load - see Start.
+package trace
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Entry is one recorded FUSE operation. Path is the directory entry name
+// or, for ops that don't touch one directly (Read, Write, Setattr, ...),
+// the target's inode - Dir and File don't track their own absolute path,
+// so that's the most specific identifier available at the call site.
+type Entry struct {
+	Timestamp time.Time     `json:"timestamp"`
+	Op        string        `json:"op"`
+	Uid       uint32        `json:"uid"`
+	Gid       uint32        `json:"gid"`
+	Pid       uint32        `json:"pid"`
+	Path      string        `json:"path"`
+	Args      string        `json:"args,omitempty"`
+	Duration  time.Duration `json:"duration"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// Sink is anywhere a Tracer can deliver recorded entries: a file, a
+// terminal, a streaming socket. Write must be safe to call concurrently.
+type Sink interface {
+	Write(Entry) error
+	Close() error
+}
+
+// Tracer owns a Sink and the sampling rate every recorded operation is
+// subject to. Callers don't construct Entry values directly; Start and
+// the finish function it returns do the timing and sampling.
+type Tracer struct {
+	sink   Sink
+	sample float64
+}
+
+// New returns a Tracer that records to sink, keeping a fraction `sample`
+// of operations (1.0 records everything, 0.01 records about 1 in 100).
+func New(sink Sink, sample float64) *Tracer {
+	if sample > 1 {
+		sample = 1
+	} else if sample < 0 {
+		sample = 0
+	}
+
+	return &Tracer{sink: sink, sample: sample}
+}
+
+var (
+	enabled atomic.Bool
+	current atomic.Pointer[Tracer]
+)
+
+// SetGlobal installs t as the process-wide tracer every Dir/File method
+// reports to. Passing nil disables tracing. Not safe to call concurrently
+// with itself; main does this once, before fs.Serve starts.
+func SetGlobal(t *Tracer) {
+	current.Store(t)
+	enabled.Store(t != nil)
+}
+
+// Global returns the currently installed tracer, or nil if tracing is off.
+func Global() *Tracer {
+	return current.Load()
+}
+
+// noop is the finish callback Start hands back when tracing is disabled
+// or an operation was sampled out, so the disabled path never allocates a
+// closure of its own.
+var noop = func(error) {}
+
+// Enabled reports whether a tracer is currently installed. Call sites
+// that need to skip work other than the path/args formatting Start
+// already defers (see below) can check this before doing it.
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// Start begins timing op and returns a function that records the entry
+// when called with the operation's final error (nil on success). detail
+// is called to produce the path/args strings only once Start has
+// confirmed the entry will actually be recorded (tracing on and, if
+// sampling is active, this call landed in-sample). When tracing is
+// disabled, Start does a single atomic bool load; when this call is
+// sampled out, it also loads the tracer and draws one random number. In
+// both cases it never calls detail and returns noop - the fmt.Sprintf
+// work callers build path/args with never runs on the hot path.
+//
+// Callers use it as:
+//
+//	finish := trace.Start("Read", req.Header.Uid, req.Header.Gid, req.Header.Pid, func() (string, string) {
+//		return fmt.Sprintf("<inode %d>", file.Attributes.Inode), fmt.Sprintf("offset=%d size=%d", req.Offset, req.Size)
+//	})
+//	defer func() { finish(err) }()
+func Start(op string, uid, gid, pid uint32, detail func() (path, args string)) func(error) {
+	if !enabled.Load() {
+		return noop
+	}
+
+	t := current.Load()
+	if t == nil {
+		return noop
+	}
+
+	if t.sample < 1 && rand.Float64() >= t.sample {
+		return noop
+	}
+
+	var path, args string
+	if detail != nil {
+		path, args = detail()
+	}
+
+	started := time.Now()
+	return func(err error) {
+		e := Entry{
+			Timestamp: started,
+			Op:        op,
+			Uid:       uid,
+			Gid:       gid,
+			Pid:       pid,
+			Path:      path,
+			Args:      args,
+			Duration:  time.Since(started),
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+
+		_ = t.sink.Write(e)
+	}
+}
+
+// Close shuts down the global tracer's sink, if one is installed. Called
+// once from main during unmount.
+func Close() error {
+	t := current.Load()
+	if t == nil {
+		return nil
+	}
+
+	return t.sink.Close()
+}
+
+// NewSink parses a -trace flag value into a Sink: "stderr", "jsonl:/path",
+// or "unix:/path".
+func NewSink(spec string) (Sink, error) {
+	switch {
+	case spec == "stderr":
+		return StderrSink{}, nil
+
+	case strings.HasPrefix(spec, "jsonl:"):
+		path := strings.TrimPrefix(spec, "jsonl:")
+		if path == "" {
+			return nil, fmt.Errorf("trace sink %q: missing path", spec)
+		}
+		return NewJSONLSink(path, defaultRotateBytes)
+
+	case strings.HasPrefix(spec, "unix:"):
+		path := strings.TrimPrefix(spec, "unix:")
+		if path == "" {
+			return nil, fmt.Errorf("trace sink %q: missing path", spec)
+		}
+		return NewUnixSink(path)
+
+	default:
+		return nil, fmt.Errorf("unknown trace sink %q: want stderr, jsonl:/path, or unix:/path", spec)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2025 Nathanne Isip
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// UnixSink streams one JSON object per line to every client currently
+// connected to a Unix domain socket, so an external tool can
+// `nc -U /path | jq` or similar to watch decrypted access patterns live
+// without the tracer ever touching disk. A write that fails (the client
+// went away) just drops that connection rather than failing the op being
+// traced.
+type UnixSink struct {
+	mux   sync.Mutex
+	ln    net.Listener
+	conns map[net.Conn]struct{}
+}
+
+// NewUnixSink removes any stale socket left behind by a previous run,
+// listens at path, and starts accepting client connections in the
+// background.
+func NewUnixSink(path string) (*UnixSink, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("remove stale trace socket: %w", err)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listen trace socket: %w", err)
+	}
+
+	s := &UnixSink{ln: ln, conns: make(map[net.Conn]struct{})}
+	go s.acceptLoop()
+
+	return s, nil
+}
+
+func (s *UnixSink) acceptLoop() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mux.Lock()
+		s.conns[conn] = struct{}{}
+		s.mux.Unlock()
+	}
+}
+
+func (s *UnixSink) Write(e Entry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal trace entry: %w", err)
+	}
+	buf = append(buf, '\n')
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for conn := range s.conns {
+		if _, err := conn.Write(buf); err != nil {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+
+	return nil
+}
+
+func (s *UnixSink) Close() error {
+	s.mux.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+	s.mux.Unlock()
+
+	return s.ln.Close()
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2025 Nathanne Isip
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// Xattr size limits, matching what most Linux filesystems that support
+// extended attributes (ext4, XFS) enforce in practice.
+const (
+	maxXattrValueSize = 64 * 1024
+	maxXattrTotalSize = 256 * 1024
+)
+
+// validXattrName restricts attributes to the namespaces user space tools
+// actually rely on (SELinux labels under security.*, mime types and tags
+// under user./trusted.*); anything else, including the system.* names
+// POSIX ACLs use, is rejected rather than silently accepted and then
+// never interpreted by anything.
+func validXattrName(name string) bool {
+	return strings.HasPrefix(name, "user.") ||
+		strings.HasPrefix(name, "trusted.") ||
+		strings.HasPrefix(name, "security.")
+}
+
+func xattrsTotalSize(xattrs map[string][]byte) int {
+	total := 0
+	for name, value := range xattrs {
+		total += len(name) + len(value)
+	}
+
+	return total
+}
+
+// checkSetxattr validates a Setxattr request against the namespace and
+// size limits shared by Dir and File.
+func checkSetxattr(name string, value []byte, existing map[string][]byte) error {
+	if !validXattrName(name) {
+		return syscall.EOPNOTSUPP
+	}
+
+	if len(value) > maxXattrValueSize {
+		return syscall.E2BIG
+	}
+
+	total := xattrsTotalSize(existing) - len(existing[name]) + len(value)
+	if total > maxXattrTotalSize {
+		return syscall.E2BIG
+	}
+
+	return nil
+}